@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+// backupName is the name of the virtual file in the control
+// directory that holds a consistent copy of the whole database.
+const backupName = "backup.db"
+
+// backupFile is the virtual file called backupName. Every open sees
+// the database as of that moment, streamed with tx.WriteTo from a
+// read transaction that stays open until the handle is released.
+//
+// Like any long-running read transaction, an open backup keeps Bolt
+// from remapping the database file, and so writes that need the file
+// to grow wait until the backup is closed.
+type backupFile struct {
+	fs *FS
+
+	mu sync.Mutex
+	// open handles, oldest first
+	handles []*backupHandle
+}
+
+var _ = fs.Node(&backupFile{})
+
+// Attr reports the size of the database as it is now, which is what
+// opening the file will copy unless it is changed in between. As it
+// changes with every commit, the kernel is told not to cache it.
+func (b *backupFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	now := time.Now()
+	a.Valid = 0
+	a.Inode = virtualInode(ctlName, backupName)
+	a.Mode = 0444
+	a.Nlink = 1
+	a.Uid = b.fs.uid
+	a.Gid = b.fs.gid
+	a.Atime = now
+	a.Mtime = now
+	a.Ctime = now
+	fn := func(tx *bolt.Tx) error {
+		a.Size = uint64(tx.Size())
+		return nil
+	}
+	return translateError(b.fs.db.View(fn))
+}
+
+var _ = fs.NodeGetattrer(&backupFile{})
+
+// Getattr is Attr, except that right after an open, as with the
+// fstat(2) cp does before copying, the size is that of the copy the
+// handle reads.
+func (b *backupFile) Getattr(ctx context.Context, req *fuse.GetattrRequest, resp *fuse.GetattrResponse) error {
+	if err := b.Attr(ctx, &resp.Attr); err != nil {
+		return err
+	}
+	if h := b.handleFor(req); h != nil {
+		resp.Attr.Size = uint64(h.size)
+	}
+	return nil
+}
+
+// handleFor returns the open handle req is for, if any. Only some
+// requests name their handle, like an lseek(2) to the end; Linux
+// does not for fstat(2). Otherwise, or if no handle has seen that ID
+// yet, which they only learn from their first read, it is the one
+// handle not read from yet that the same process opened. If there
+// are several, as when a process opens the file twice, there is no
+// telling which one is meant, and nil is returned.
+func (b *backupFile) handleFor(req *fuse.GetattrRequest) *backupHandle {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var fresh *backupHandle
+	n := 0
+	for _, h := range b.handles {
+		h.mu.Lock()
+		id, hasID := h.id, h.hasID
+		h.mu.Unlock()
+		switch {
+		case hasID && req.Flags&fuse.GetattrFh != 0 && id == req.Handle:
+			return h
+		case !hasID && h.pid == req.Pid:
+			fresh = h
+			n++
+		}
+	}
+	if n != 1 {
+		return nil
+	}
+	return fresh
+}
+
+var _ = fs.NodeOpener(&backupFile{})
+
+func (b *backupFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	tx, err := b.fs.db.Begin(false)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	h := &backupHandle{
+		file: b,
+		tx:   tx,
+		size: tx.Size(),
+		pid:  req.Pid,
+	}
+	h.start()
+	b.mu.Lock()
+	b.handles = append(b.handles, h)
+	b.mu.Unlock()
+	// the contents differ between opens, and are generated in
+	// order; keep the kernel from caching or reading ahead
+	resp.Flags |= fuse.OpenDirectIO
+	return h, nil
+}
+
+// backupHandle is an open backupFile. The database is written into a
+// pipe as it is read; reads are expected to be sequential, and the
+// copy is restarted from the beginning for a read before the current
+// position.
+type backupHandle struct {
+	file *backupFile
+	tx   *bolt.Tx
+	size int64
+	// the process that opened it
+	pid uint32
+
+	mu sync.Mutex
+	r  *io.PipeReader
+	// closed when the writing goroutine is done
+	done chan struct{}
+	// position of r in the copy
+	pos int64
+	// the ID the kernel knows the handle by, once it has been read
+	// from
+	id    fuse.HandleID
+	hasID bool
+}
+
+// start begins copying the transaction from the beginning. Caller
+// must hold h.mu, unless h is not yet visible to anyone else.
+func (h *backupHandle) start() {
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := h.tx.WriteTo(w)
+		w.CloseWithError(err)
+	}()
+	h.r = r
+	h.done = done
+	h.pos = 0
+}
+
+// stop aborts the copy in progress. Caller must hold h.mu.
+func (h *backupHandle) stop() {
+	h.r.Close()
+	<-h.done
+}
+
+var _ = fs.HandleReader(&backupHandle{})
+
+func (h *backupHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.id = req.Handle
+	h.hasID = true
+	if req.Offset >= h.size {
+		return nil
+	}
+	if req.Offset < h.pos {
+		h.stop()
+		h.start()
+	}
+	if req.Offset > h.pos {
+		n, err := io.CopyN(ioutil.Discard, h.r, req.Offset-h.pos)
+		h.pos += n
+		if err != nil {
+			return backupError(err)
+		}
+	}
+	buf := make([]byte, req.Size)
+	n, err := io.ReadFull(h.r, buf)
+	h.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		// end of the copy
+		err = nil
+	}
+	if err != nil {
+		return backupError(err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+// backupError reports a failure to copy the database. The copy is
+// never cut short otherwise, because reads past its end return early.
+func backupError(err error) error {
+	log.Printf("backup: %v", err)
+	return fuse.EIO
+}
+
+var _ = fs.HandleReleaser(&backupHandle{})
+
+func (h *backupHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	b := h.file
+	b.mu.Lock()
+	for i, other := range b.handles {
+		if other == h {
+			b.handles = append(b.handles[:i], b.handles[i+1:]...)
+			break
+		}
+	}
+	b.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stop()
+	return translateError(h.tx.Rollback())
+}
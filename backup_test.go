@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+func TestBackup(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("greeting"), []byte("hello"))
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		filesys := &FS{db: db}
+		n := &backupFile{fs: filesys}
+		var a fuse.Attr
+		if err := n.Attr(ctx, &a); err != nil {
+			t.Fatal(err)
+		}
+		hh, err := n.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := hh.(*backupHandle)
+		defer h.Release(ctx, &fuse.ReleaseRequest{})
+
+		read := func(offset int64, size int) []byte {
+			req := &fuse.ReadRequest{Offset: offset, Size: size}
+			resp := &fuse.ReadResponse{}
+			if err := h.Read(ctx, req, resp); err != nil {
+				t.Fatal(err)
+			}
+			return resp.Data
+		}
+
+		var buf bytes.Buffer
+		for {
+			data := read(int64(buf.Len()), 1000)
+			if len(data) == 0 {
+				break
+			}
+			buf.Write(data)
+		}
+		if g, e := uint64(buf.Len()), a.Size; g != e {
+			t.Errorf("backup size differs from attr: %d != %d", g, e)
+		}
+		// going back restarts the copy
+		if g, e := read(10, 20), buf.Bytes()[10:30]; !bytes.Equal(g, e) {
+			t.Errorf("reread differs: %x != %x", g, e)
+		}
+
+		tmp, err := ioutil.TempDir("", "bolt-mount-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		p := filepath.Join(tmp, "backup.db")
+		if err := ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		backup, err := bolt.Open(p, 0644, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer backup.Close()
+		check := func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("bukkit"))
+			if b == nil {
+				t.Fatalf("bukkit not in backup")
+			}
+			if g, e := string(b.Get([]byte("greeting"))), "hello"; g != e {
+				t.Errorf("wrong value in backup: %q != %q", g, e)
+			}
+			return nil
+		}
+		if err := backup.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBackupFstatSize(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bolt-mount-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	// room to grow without remapping, which waits for the open
+	// backups
+	db, err := bolt.Open(filepath.Join(tmp, "db"), 0600, &bolt.Options{InitialMmapSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	grow := func() {
+		fn := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			key := []byte(fmt.Sprintf("key%d", b.Stats().KeyN))
+			return b.Put(key, make([]byte, 10000))
+		}
+		if err := db.Update(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grow()
+
+	ctx := context.Background()
+	filesys := &FS{db: db}
+	n := &backupFile{fs: filesys}
+	open := func(pid uint32) *backupHandle {
+		req := &fuse.OpenRequest{Flags: fuse.OpenReadOnly}
+		req.Pid = pid
+		hh, err := n.Open(ctx, req, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hh.(*backupHandle)
+	}
+	// as with fstat(2), which does not say which handle it is for
+	fstat := func(pid uint32) uint64 {
+		req := &fuse.GetattrRequest{}
+		req.Pid = pid
+		resp := &fuse.GetattrResponse{}
+		if err := n.Getattr(ctx, req, resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Attr.Size
+	}
+
+	// two copies started together
+	h1 := open(1)
+	defer h1.Release(ctx, &fuse.ReleaseRequest{})
+	grow()
+	h2 := open(2)
+	defer h2.Release(ctx, &fuse.ReleaseRequest{})
+	grow()
+	if h1.size == h2.size {
+		t.Fatalf("database did not grow: %d", h1.size)
+	}
+	if g, e := fstat(1), uint64(h1.size); g != e {
+		t.Errorf("wrong size for first process: %d != %d", g, e)
+	}
+	if g, e := fstat(2), uint64(h2.size); g != e {
+		t.Errorf("wrong size for second process: %d != %d", g, e)
+	}
+
+	if err := h1.Read(ctx, &fuse.ReadRequest{Handle: 1, Size: 100}, &fuse.ReadResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	req := &fuse.GetattrRequest{Flags: fuse.GetattrFh, Handle: 1}
+	resp := &fuse.GetattrResponse{}
+	if err := n.Getattr(ctx, req, resp); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := resp.Attr.Size, uint64(h1.size); g != e {
+		t.Errorf("wrong size of first handle: %d != %d", g, e)
+	}
+
+	var a fuse.Attr
+	if err := n.Attr(ctx, &a); err != nil {
+		t.Fatal(err)
+	}
+	// read from already, so not fresh
+	if g, e := fstat(1), a.Size; g != e {
+		t.Errorf("wrong size without a fresh handle: %d != %d", g, e)
+	}
+	// two fresh handles in one process are ambiguous
+	h3 := open(2)
+	defer h3.Release(ctx, &fuse.ReleaseRequest{})
+	if g, e := fstat(2), a.Size; g != e {
+		t.Errorf("wrong size with two fresh handles: %d != %d", g, e)
+	}
+}
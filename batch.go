@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// groupCommit runs read-write transactions so that callers that come
+// in together share commits, and with them the fsyncs.
+//
+// Unlike db.Batch, a call never waits for others to show up: if no
+// commit is in progress, it commits right away, so a writer on its
+// own is as fast as with db.Update. Calls that come in while a commit
+// is in progress wait for it, and then all go into the next one.
+type groupCommit struct {
+	db *bolt.DB
+	// most calls to put in one commit; 0 for no limit
+	maxSize int
+	// how long a commit that calls are already waiting for waits for
+	// more to join it, unless maxSize is reached first; 0 to not wait
+	maxDelay time.Duration
+
+	mu sync.Mutex
+	// a goroutine is running commits
+	running bool
+	// calls waiting for the next commit
+	queue []*groupCall
+	// closed once the queue is full, while waiting for maxDelay
+	full chan struct{}
+}
+
+type groupCall struct {
+	fn   func(*bolt.Tx) error
+	err  error
+	done chan error
+}
+
+// update runs fn in a read-write transaction, and returns once that
+// has been committed. If fn returns an error, the transaction is
+// rolled back and retried without it, so fn may be called more than
+// once, and must be idempotent.
+func (g *groupCommit) update(fn func(*bolt.Tx) error) error {
+	call := &groupCall{fn: fn, done: make(chan error, 1)}
+	g.mu.Lock()
+	g.queue = append(g.queue, call)
+	if g.full != nil && g.maxSize > 0 && len(g.queue) >= g.maxSize {
+		close(g.full)
+		g.full = nil
+	}
+	if !g.running {
+		g.running = true
+		go g.loop()
+	}
+	g.mu.Unlock()
+	return <-call.done
+}
+
+// loop commits the queue until it is empty.
+func (g *groupCommit) loop() {
+	// calls came in during the last commit
+	busy := false
+	for {
+		g.mu.Lock()
+		if len(g.queue) == 0 {
+			g.running = false
+			g.mu.Unlock()
+			return
+		}
+		if busy && g.maxDelay > 0 && (g.maxSize <= 0 || len(g.queue) < g.maxSize) {
+			// others are writing too; give more of them a chance
+			// to join
+			full := make(chan struct{})
+			g.full = full
+			g.mu.Unlock()
+			t := time.NewTimer(g.maxDelay)
+			select {
+			case <-full:
+			case <-t.C:
+			}
+			t.Stop()
+			g.mu.Lock()
+			g.full = nil
+		}
+		n := len(g.queue)
+		if g.maxSize > 0 && n > g.maxSize {
+			n = g.maxSize
+		}
+		calls := append([]*groupCall(nil), g.queue[:n]...)
+		g.queue = g.queue[n:]
+		g.mu.Unlock()
+
+		g.commit(calls)
+		// before any caller can come back with another call, so
+		// that a single writer never waits for maxDelay
+		g.mu.Lock()
+		busy = len(g.queue) > 0
+		g.mu.Unlock()
+		for _, call := range calls {
+			call.done <- call.err
+		}
+	}
+}
+
+// commit runs calls in one transaction, and records the outcome in
+// each of them. A call whose fn fails gets its error, and the rest
+// are retried without it.
+func (g *groupCommit) commit(calls []*groupCall) {
+	for len(calls) > 0 {
+		failed := -1
+		err := g.db.Update(func(tx *bolt.Tx) error {
+			for i, call := range calls {
+				if err := call.fn(tx); err != nil {
+					failed = i
+					return err
+				}
+			}
+			return nil
+		})
+		if failed < 0 {
+			for _, call := range calls {
+				call.err = err
+			}
+			return
+		}
+		calls[failed].err = err
+		calls = append(calls[:failed:failed], calls[failed+1:]...)
+	}
+}
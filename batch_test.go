@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestGroupCommitAlone(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		gc := &groupCommit{db: db, maxDelay: time.Hour}
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			fn := func(tx *bolt.Tx) error {
+				_, err := tx.CreateBucketIfNotExists([]byte("bukkit"))
+				return err
+			}
+			if err := gc.update(fn); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// one writer at a time never waits for others
+		if d := time.Since(start); d > time.Minute {
+			t.Errorf("sequential updates waited: %v", d)
+		}
+	})
+}
+
+func TestGroupCommitShared(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		gc := &groupCommit{db: db}
+		var mu sync.Mutex
+		txs := make(map[*bolt.Tx]bool)
+		entered := make(chan struct{})
+		release := make(chan struct{})
+		put := func(key string, hold bool) func(*bolt.Tx) error {
+			return func(tx *bolt.Tx) error {
+				if hold {
+					close(entered)
+					<-release
+				}
+				mu.Lock()
+				txs[tx] = true
+				mu.Unlock()
+				b, err := tx.CreateBucketIfNotExists([]byte("bukkit"))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte(key), []byte("x"))
+			}
+		}
+
+		// hold up the first commit until the others are queued
+		const n = 10
+		errs := make(chan error, n)
+		go func() { errs <- gc.update(put("key0", true)) }()
+		<-entered
+		for i := 1; i < n; i++ {
+			go func(i int) { errs <- gc.update(put(fmt.Sprintf("key%d", i), false)) }(i)
+		}
+		for {
+			gc.mu.Lock()
+			queued := len(gc.queue)
+			gc.mu.Unlock()
+			if queued == n-1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		for i := 0; i < n; i++ {
+			if err := <-errs; err != nil {
+				t.Error(err)
+			}
+		}
+		if g, e := len(txs), 2; g != e {
+			t.Errorf("wrong number of transactions: %d != %d", g, e)
+		}
+		check := func(tx *bolt.Tx) error {
+			if g, e := tx.Bucket([]byte("bukkit")).Stats().KeyN, n; g != e {
+				t.Errorf("wrong number of keys: %d != %d", g, e)
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestGroupCommitFailure(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		gc := &groupCommit{db: db}
+		errBoom := errors.New("boom")
+		entered := make(chan struct{})
+		release := make(chan struct{})
+		first := make(chan error, 1)
+		go func() {
+			first <- gc.update(func(tx *bolt.Tx) error {
+				close(entered)
+				<-release
+				return nil
+			})
+		}()
+		<-entered
+
+		// both queued behind the first commit, so they share the next
+		errs := make(chan error, 2)
+		go func() {
+			errs <- gc.update(func(tx *bolt.Tx) error {
+				if _, err := tx.CreateBucketIfNotExists([]byte("bad")); err != nil {
+					return err
+				}
+				return errBoom
+			})
+		}()
+		go func() {
+			errs <- gc.update(func(tx *bolt.Tx) error {
+				_, err := tx.CreateBucketIfNotExists([]byte("good"))
+				return err
+			})
+		}()
+		for {
+			gc.mu.Lock()
+			queued := len(gc.queue)
+			gc.mu.Unlock()
+			if queued == 2 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		if err := <-first; err != nil {
+			t.Fatal(err)
+		}
+		var failed int
+		for i := 0; i < 2; i++ {
+			switch err := <-errs; err {
+			case nil:
+			case errBoom:
+				failed++
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+		if failed != 1 {
+			t.Errorf("wrong number of failures: %d", failed)
+		}
+		check := func(tx *bolt.Tx) error {
+			if tx.Bucket([]byte("bad")) != nil {
+				t.Error("changes of failed call were committed")
+			}
+			if tx.Bucket([]byte("good")) == nil {
+				t.Error("changes of other call were not committed")
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxNameLen is the longest file name most systems allow, in bytes.
+const maxNameLen = 255
+
+// errNameTooLong is returned by KeyCodec.Encode for keys whose file
+// name would be longer than maxNameLen.
+var errNameTooLong = errors.New("file name for key is too long")
+
+// A KeyCodec maps raw keys to file names and back.
+//
+// Decode must return the key for every name Encode returns, and
+// Encode must never return a name longer than maxNameLen, or one
+// with a leading dot, which is reserved for virtual files.
+type KeyCodec interface {
+	// Encode returns the file name of a non-empty key, or
+	// errNameTooLong if the key cannot be shown.
+	Encode(key []byte) (string, error)
+	// Decode returns the key of a file name, or an error if the
+	// name is not one Encode could return.
+	Decode(name string) ([]byte, error)
+}
+
+// codecs are the key codecs that can be selected by name.
+var codecs = map[string]KeyCodec{
+	"bolt":      boltCodec{},
+	"base64url": base64Codec{},
+	"percent":   percentCodec{},
+	"hex":       hexCodec{},
+}
+
+// lookupCodec returns the codec called name.
+func lookupCodec(name string) (KeyCodec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding %q, must be one of %s", name, strings.Join(codecNames(), ", "))
+	}
+	return c, nil
+}
+
+// codecNames returns the names of all codecs, sorted.
+func codecNames() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkLen returns name, or errNameTooLong if it is too long.
+func checkLen(name string) (string, error) {
+	if len(name) > maxNameLen {
+		return "", errNameTooLong
+	}
+	return name, nil
+}
+
+// boltCodec is EncodeKey and DecodeKey, which keep printable parts
+// of keys readable.
+type boltCodec struct{}
+
+func (boltCodec) Encode(key []byte) (string, error) {
+	return checkLen(EncodeKey(key))
+}
+
+// Decode accepts every spelling DecodeKey does, not only the names
+// Encode returns, as it did before there was a choice of codecs.
+func (boltCodec) Decode(name string) ([]byte, error) {
+	return DecodeKey(name)
+}
+
+// base64Codec encodes keys in unpadded base64 with the URL-safe
+// alphabet.
+type base64Codec struct{}
+
+var base64Encoding = base64.RawURLEncoding.Strict()
+
+func (base64Codec) Encode(key []byte) (string, error) {
+	return checkLen(base64Encoding.EncodeToString(key))
+}
+
+func (base64Codec) Decode(name string) ([]byte, error) {
+	return base64Encoding.DecodeString(name)
+}
+
+// percentCodec keeps unreserved URL characters, and percent-encodes
+// every other byte, as well as a leading dot.
+type percentCodec struct{}
+
+func isUnreserved(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	case c == '-', c == '_', c == '.', c == '~':
+		return true
+	}
+	return false
+}
+
+func (percentCodec) Encode(key []byte) (string, error) {
+	const upperhex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i, c := range key {
+		if isUnreserved(c) && !(i == 0 && c == '.') {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(upperhex[c>>4])
+		b.WriteByte(upperhex[c&0xf])
+	}
+	return checkLen(b.String())
+}
+
+func (c percentCodec) Decode(name string) ([]byte, error) {
+	key := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			key = append(key, name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return nil, fmt.Errorf("truncated escape in %q", name)
+		}
+		b, err := hex.DecodeString(name[i+1 : i+3])
+		if err != nil {
+			return nil, err
+		}
+		key = append(key, b[0])
+		i += 2
+	}
+	// only one name per key, so lookups agree with listings
+	if enc, err := c.Encode(key); err != nil || enc != name {
+		return nil, fmt.Errorf("not a canonical name: %q", name)
+	}
+	return key, nil
+}
+
+// hexCodec encodes keys in lowercase hexadecimal.
+type hexCodec struct{}
+
+func (hexCodec) Encode(key []byte) (string, error) {
+	return checkLen(hex.EncodeToString(key))
+}
+
+func (hexCodec) Decode(name string) ([]byte, error) {
+	key, err := hex.DecodeString(name)
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(key) != name {
+		return nil, fmt.Errorf("not a canonical name: %q", name)
+	}
+	return key, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+func codecKeys() [][]byte {
+	keys := [][]byte{
+		[]byte("greeting"),
+		[]byte(".evil"),
+		[]byte("evil:lol/mwahaha"),
+		[]byte("%41"),
+		{0},
+		{0xff, 0xfe, '.', '.'},
+		[]byte(strings.Repeat("x", 255)),
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		key := make([]byte, 1+r.Intn(64))
+		r.Read(key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestCodecRoundtrip(t *testing.T) {
+	for name, c := range codecs {
+		for _, key := range codecKeys() {
+			enc, err := c.Encode(key)
+			if err == errNameTooLong {
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: encode %x: %v", name, key, err)
+				continue
+			}
+			if len(enc) > maxNameLen {
+				t.Errorf("%s: name too long: %d bytes", name, len(enc))
+			}
+			if strings.HasPrefix(enc, ".") {
+				t.Errorf("%s: leading dot in %q", name, enc)
+			}
+			if strings.ContainsAny(enc, "/\x00") {
+				t.Errorf("%s: invalid file name %q", name, enc)
+			}
+			dec, err := c.Decode(enc)
+			if err != nil {
+				t.Errorf("%s: decode %q: %v", name, enc, err)
+				continue
+			}
+			if !bytes.Equal(dec, key) {
+				t.Errorf("%s: roundtrip %x -> %q -> %x", name, key, enc, dec)
+			}
+		}
+	}
+}
+
+func TestCodecNameTooLong(t *testing.T) {
+	key := bytes.Repeat([]byte{0xff}, maxNameLen)
+	for name, c := range codecs {
+		if _, err := c.Encode(key); err != errNameTooLong {
+			t.Errorf("%s: expected errNameTooLong, got %v", name, err)
+		}
+	}
+}
+
+func TestReaddirNameTooLong(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put(bytes.Repeat([]byte{0xff}, maxNameLen), []byte("x")); err != nil {
+				return err
+			}
+			return b.Put([]byte("short"), []byte("y"))
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		filesys := &FS{db: db}
+		d := filesys.dirNode([][]byte{[]byte("bukkit")})
+		for i := 0; i < 2; i++ {
+			dirs, err := d.ReadDirAll(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dirs) != 1 || dirs[0].Name != "short" {
+				t.Errorf("wrong listing: %+v", dirs)
+			}
+		}
+		if g, e := filesys.Stats().KeysHidden, uint64(2); g != e {
+			t.Errorf("wrong KeysHidden: %d != %d", g, e)
+		}
+	})
+}
+
+func TestCodecNonCanonical(t *testing.T) {
+	for _, tc := range []struct {
+		codec string
+		name  string
+	}{
+		{"hex", "ABCD"},
+		{"percent", "%61"},
+		{"percent", "%4"},
+		{"percent", ".x"},
+		{"base64url", "QR"},
+	} {
+		if _, err := codecs[tc.codec].Decode(tc.name); err == nil {
+			t.Errorf("%s: %q decoded without error", tc.codec, tc.name)
+		}
+	}
+}
+
+func TestLookupCodec(t *testing.T) {
+	if _, err := lookupCodec("hex"); err != nil {
+		t.Error(err)
+	}
+	if _, err := lookupCodec("rot13"); err == nil {
+		t.Error("unknown codec found")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fuseutil"
+	"golang.org/x/net/context"
+)
+
+// ctlName is the name of the virtual directory at the root of the
+// mount that shows the internals of the database. It cannot collide
+// with a bucket, because no KeyCodec produces names with a leading
+// dot.
+//
+// Virtual nodes can be looked up by name, but are not listed, so
+// that copying or archiving the mount only picks up real data.
+const ctlName = ".bolt"
+
+// ctlReports are the reports in the control directory. Each is shown
+// as a text file, with a line per field, and as a JSON file.
+var ctlReports = []struct {
+	name   string
+	report func(*FS) (interface{}, error)
+}{
+	{"counters", func(f *FS) (interface{}, error) { return f.Stats(), nil }},
+	{"info", (*FS).info},
+	{"stats", func(f *FS) (interface{}, error) { return f.db.Stats(), nil }},
+}
+
+// Info describes the database file.
+type Info struct {
+	Path     string
+	PageSize int
+	FileSize int64
+}
+
+func (f *FS) info() (interface{}, error) {
+	fi, err := os.Stat(f.db.Path())
+	if err != nil {
+		return nil, err
+	}
+	i := Info{
+		Path:     f.db.Path(),
+		PageSize: f.db.Info().PageSize,
+		FileSize: fi.Size(),
+	}
+	return i, nil
+}
+
+// virtualInode returns the inode number of a virtual node. They are
+// hashed from a different space than the paths of keys and buckets.
+func virtualInode(path ...string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte("bolt-mount virtual"))
+	for _, seg := range path {
+		h.Write([]byte{0})
+		h.Write([]byte(seg))
+	}
+	ino := h.Sum64()
+	if ino < 2 {
+		ino += 2
+	}
+	return ino
+}
+
+// isRoot reports whether d is the root of the mount.
+func (d *Dir) isRoot() bool {
+	// every other bucket in the mount is below the root
+	return len(d.path()) == len(d.fs.root)
+}
+
+// virtualNode returns the virtual node called name in d, or nil if
+// there is none.
+func (d *Dir) virtualNode(name string) fs.Node {
+	switch {
+	case name == ctlName && d.isRoot():
+		return &ctlDir{fs: d.fs}
+	case len(d.path()) == 0:
+		// the root of the database is not a bucket, and has no
+		// sequence
+		return nil
+	case name == seqName:
+		return &seqFile{dir: d}
+	case name == nextName:
+		return &nextFile{dir: d}
+	}
+	return nil
+}
+
+// ctlDir is the virtual directory called ctlName.
+type ctlDir struct {
+	fs *FS
+}
+
+var _ = fs.Node(&ctlDir{})
+
+func (c *ctlDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = virtualInode(ctlName)
+	a.Mode = os.ModeDir | 0555
+	a.Uid = c.fs.uid
+	a.Gid = c.fs.gid
+	return nil
+}
+
+var _ = fs.HandleReadDirAller(&ctlDir{})
+
+func (c *ctlDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	res := []fuse.Dirent{{
+		Inode: virtualInode(ctlName, backupName),
+		Type:  fuse.DT_File,
+		Name:  backupName,
+	}}
+	for _, r := range ctlReports {
+		for _, name := range []string{r.name, r.name + ".json"} {
+			de := fuse.Dirent{
+				Inode: virtualInode(ctlName, name),
+				Type:  fuse.DT_File,
+				Name:  name,
+			}
+			res = append(res, de)
+		}
+	}
+	return res, nil
+}
+
+var _ = fs.NodeStringLookuper(&ctlDir{})
+
+func (c *ctlDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name == backupName {
+		return &backupFile{fs: c.fs}, nil
+	}
+	base := strings.TrimSuffix(name, ".json")
+	for _, r := range ctlReports {
+		if r.name == base {
+			n := &ctlFile{
+				fs:     c.fs,
+				name:   name,
+				report: r.report,
+				json:   base != name,
+			}
+			return n, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+// ctlFile is a read-only virtual file with a report in the control
+// directory. Its contents are generated when it is opened; as their
+// size is not known before that, reads bypass the page cache.
+type ctlFile struct {
+	fs     *FS
+	name   string
+	report func(*FS) (interface{}, error)
+	json   bool
+}
+
+var _ = fs.Node(&ctlFile{})
+
+func (c *ctlFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = virtualInode(ctlName, c.name)
+	a.Mode = 0444
+	a.Uid = c.fs.uid
+	a.Gid = c.fs.gid
+	return nil
+}
+
+var _ = fs.NodeOpener(&ctlFile{})
+
+func (c *ctlFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	v, err := c.report(c.fs)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	var data []byte
+	if c.json {
+		data, err = json.MarshalIndent(v, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, '\n')
+	} else {
+		data = renderText(v)
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return &ctlHandle{data: data}, nil
+}
+
+// ctlHandle is an open ctlFile.
+type ctlHandle struct {
+	// contents generated at open
+	data []byte
+}
+
+var _ = fs.HandleReader(&ctlHandle{})
+
+func (h *ctlHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	fuseutil.HandleRead(req, resp, h.data)
+	return nil
+}
+
+// renderText formats the fields of the struct v as lines of name and
+// value, with the fields of nested structs named by dotted paths.
+func renderText(v interface{}) []byte {
+	var buf bytes.Buffer
+	writeFields(&buf, "", reflect.ValueOf(v))
+	return buf.Bytes()
+}
+
+func writeFields(buf *bytes.Buffer, prefix string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			writeFields(buf, prefix+field.Name+".", fv)
+			continue
+		}
+		fmt.Fprintf(buf, "%s%s %v\n", prefix, field.Name, fv.Interface())
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+// readCtl returns the contents of the file name in the control
+// directory of filesys.
+func readCtl(t testing.TB, filesys *FS, name string) []byte {
+	ctx := context.Background()
+	root, err := filesys.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl, err := root.(*Dir).Lookup(ctx, ctlName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := ctl.(*ctlDir).Lookup(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &fuse.OpenResponse{}
+	h, err := n.(*ctlFile).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Flags&fuse.OpenDirectIO == 0 {
+		t.Errorf("control file not opened with direct I/O")
+	}
+	return h.(*ctlHandle).data
+}
+
+func TestCtlCounters(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		filesys := &FS{db: db}
+		filesys.counters.flushesSkipped = 3
+
+		var s Stats
+		if err := json.Unmarshal(readCtl(t, filesys, "counters.json"), &s); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := s.FlushesSkipped, uint64(3); g != e {
+			t.Errorf("wrong counter: %d != %d", g, e)
+		}
+	})
+}
+
+func TestCtlInfo(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		filesys := &FS{db: db}
+		var i Info
+		if err := json.Unmarshal(readCtl(t, filesys, "info.json"), &i); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := i.Path, db.Path(); g != e {
+			t.Errorf("wrong path: %q != %q", g, e)
+		}
+		if g, e := i.PageSize, db.Info().PageSize; g != e {
+			t.Errorf("wrong page size: %d != %d", g, e)
+		}
+	})
+}
+
+func TestCtlLookupNotAtRoot(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("bukkit"))
+			return err
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{db: db}
+		d := filesys.dirNode([][]byte{[]byte("bukkit")})
+		if _, err := d.Lookup(context.Background(), ctlName); err != fuse.ENOENT {
+			t.Errorf("expected ENOENT, got %v", err)
+		}
+	})
+}
+
+func TestRenderText(t *testing.T) {
+	type inner struct {
+		B int
+	}
+	v := struct {
+		A      string
+		In     inner
+		hidden int
+	}{A: "x", In: inner{B: 2}}
+	if g, e := string(renderText(v)), "A x\nIn.B 2\n"; g != e {
+		t.Errorf("wrong text: %q != %q", g, e)
+	}
+}
+
+func TestCtlRenameInto(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("bukkit"))
+			return err
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		filesys := &FS{db: db}
+		root, err := filesys.Root()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctl, err := root.(*Dir).Lookup(ctx, ctlName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &fuse.RenameRequest{OldName: "bukkit", NewName: "bukkit"}
+		if err := root.(*Dir).Rename(ctx, req, ctl); err != fuse.EPERM {
+			t.Errorf("expected EPERM, got %v", err)
+		}
+	})
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
-	"errors"
+	"bytes"
+	"log"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -12,17 +17,143 @@ import (
 
 type Dir struct {
 	fs *FS
+
+	// protects buckets, which changes when the bucket is renamed
+	mu sync.Mutex
 	// path from Bolt database root to this bucket; empty for root bucket
 	buckets [][]byte
 }
 
+// path returns the raw path of the bucket. The returned slice must
+// not be modified.
+func (d *Dir) path() [][]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.buckets
+}
+
+func (d *Dir) setPath(path [][]byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.buckets = path
+}
+
 var _ = fs.Node(&Dir{})
 
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Mode = os.ModeDir | 0755
+	path := d.path()
+	a.Inode = inode(path)
+	a.Mode = os.ModeDir
+	d.fs.defaultAttr(a, 0777)
+	n, err := d.fs.children(path)
+	if err != nil {
+		return translateError(err)
+	}
+	// the number of entries, keys and sub-buckets alike
+	a.Size = uint64(n.Keys + n.Buckets)
+	// one for the entry in the parent, one for ".", and one for
+	// ".." in every sub-bucket
+	a.Nlink = uint32(2 + n.Buckets)
+	m, err := d.fs.loadMeta(path)
+	if err != nil {
+		return translateError(err)
+	}
+	m.fillAttr(a)
 	return nil
 }
 
+// childPath returns the raw path of the entry name inside d.
+func (d *Dir) childPath(name []byte) [][]byte {
+	buckets := d.path()
+	path := make([][]byte, 0, len(buckets)+1)
+	path = append(path, buckets...)
+	path = append(path, name)
+	return path
+}
+
+// codec returns the codec for the names of the entries in d, which
+// is the key format hint of the bucket, if any.
+func (d *Dir) codec(tx *bolt.Tx) (KeyCodec, error) {
+	return d.fs.codecAt(tx, d.path())
+}
+
+// codecAt returns the codec for the names of the entries in the
+// bucket at path.
+func (f *FS) codecAt(tx *bolt.Tx, path [][]byte) (KeyCodec, error) {
+	if !f.meta {
+		return f.keyCodec(), nil
+	}
+	m, err := getMeta(tx, path)
+	if err != nil {
+		return nil, err
+	}
+	if k, ok := keyFormats[m.KeyFormat]; ok {
+		return k, nil
+	}
+	return f.keyCodec(), nil
+}
+
+// displayPath returns path as it is seen inside the mount, for
+// messages.
+func (f *FS) displayPath(tx *bolt.Tx, path [][]byte) string {
+	var names []string
+	for i := len(f.root); i < len(path); i++ {
+		var name string
+		c, err := f.codecAt(tx, path[:i])
+		if err == nil {
+			name, err = c.Encode(path[i])
+		}
+		if err != nil {
+			// not seen at all, but still to be shown somehow
+			name = EncodeKey(path[i])
+		}
+		names = append(names, name)
+	}
+	return "/" + strings.Join(names, "/")
+}
+
+// decodeName returns the key of the file name inside d.
+func (d *Dir) decodeName(name string) ([]byte, error) {
+	var key []byte
+	fn := func(tx *bolt.Tx) error {
+		c, err := d.codec(tx)
+		if err != nil {
+			return err
+		}
+		key, err = c.Decode(name)
+		return err
+	}
+	err := d.fs.db.View(fn)
+	return key, err
+}
+
+// reserved reports whether name is hidden from the file system
+// because it holds data of bolt-mount itself.
+func (d *Dir) reserved(name []byte) bool {
+	return len(d.path()) == 0 && bytes.Equal(name, metaBucket)
+}
+
+var _ = fs.NodeForgetter(&Dir{})
+
+func (d *Dir) Forget() {
+	d.fs.forget(d.path(), d)
+}
+
+var _ = fs.NodeSetattrer(&Dir{})
+
+func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if d.fs.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return translateError(d.fs.setattrMeta(d.path(), req))
+}
+
+var _ = fs.NodeFsyncer(&Dir{})
+
+func (d *Dir) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	return d.fs.sync()
+}
+
 var _ = fs.HandleReadDirAller(&Dir{})
 
 type BucketLike interface {
@@ -59,14 +190,25 @@ func (fakeBucket) Delete(key []byte) error {
 //
 // It never returns a nil value in a non-nil interface.
 func (d *Dir) bucket(tx *bolt.Tx) BucketLike {
-	if len(d.buckets) == 0 {
+	buckets := d.path()
+	if len(buckets) == 0 {
 		return fakeBucket{tx}
 	}
-	b := tx.Bucket(d.buckets[0])
+	b := bucketAt(tx, buckets)
 	if b == nil {
 		return nil
 	}
-	for _, name := range d.buckets[1:] {
+	return b
+}
+
+// bucketAt returns the bucket at the non-empty path, or nil if it
+// does not exist.
+func bucketAt(tx *bolt.Tx, path [][]byte) *bolt.Bucket {
+	b := tx.Bucket(path[0])
+	if b == nil {
+		return nil
+	}
+	for _, name := range path[1:] {
 		b = b.Bucket(name)
 		if b == nil {
 			return nil
@@ -75,17 +217,43 @@ func (d *Dir) bucket(tx *bolt.Tx) BucketLike {
 	return b
 }
 
+// ReadDirAll lists the bucket in key order. The fuse package only
+// passes directory reads to ReadDirAll, and keeps the whole listing
+// for the open handle, so the listing is built in memory, in a single
+// transaction. Listing huge buckets in constant memory would need a
+// fuse server that passes directory reads on to the handle.
+//
+// Keys whose file names would be too long are left out, and counted
+// in Stats.KeysHidden; the first time that happens, it is logged.
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	var res []fuse.Dirent
+	var hidden uint64
+	var where string
 	err := d.fs.db.View(func(tx *bolt.Tx) error {
 		b := d.bucket(tx)
 		if b == nil {
-			return errors.New("bucket no longer exists")
+			return errBucketGone
+		}
+		codec, err := d.codec(tx)
+		if err != nil {
+			return err
 		}
 		c := b.Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if d.reserved(k) {
+				continue
+			}
+			name, err := codec.Encode(k)
+			if err == errNameTooLong {
+				hidden++
+				continue
+			}
+			if err != nil {
+				return err
+			}
 			de := fuse.Dirent{
-				Name: EncodeKey(k),
+				Inode: inode(d.childPath(k)),
+				Name:  name,
 			}
 			if v == nil {
 				de.Type = fuse.DT_Dir
@@ -94,62 +262,67 @@ func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 			}
 			res = append(res, de)
 		}
+		if hidden > 0 {
+			where = d.fs.displayPath(tx, d.path())
+		}
 		return nil
 	})
-	return res, err
+	if hidden > 0 && atomic.AddUint64(&d.fs.counters.keysHidden, hidden) == hidden {
+		log.Printf("not listing %d keys in %s, their file names would be longer than %d bytes", hidden, where, maxNameLen)
+	}
+	return res, translateError(err)
 }
 
 var _ = fs.NodeStringLookuper(&Dir{})
 
 func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	var n fs.Node
-	err := d.fs.db.View(func(tx *bolt.Tx) error {
+	atomic.AddUint64(&d.fs.counters.lookups, 1)
+	if n := d.virtualNode(name); n != nil {
+		return n, nil
+	}
+	nameRaw, err := d.decodeName(name)
+	if err != nil || d.reserved(nameRaw) {
+		return nil, fuse.ENOENT
+	}
+	var isDir bool
+	err = d.fs.db.View(func(tx *bolt.Tx) error {
 		b := d.bucket(tx)
 		if b == nil {
-			return errors.New("bucket no longer exists")
-		}
-		nameRaw, err := DecodeKey(name)
-		if err != nil {
-			return fuse.ENOENT
+			return errBucketGone
 		}
 		if child := b.Bucket(nameRaw); child != nil {
-			// directory
-			buckets := make([][]byte, 0, len(d.buckets)+1)
-			buckets = append(buckets, d.buckets...)
-			buckets = append(buckets, nameRaw)
-			n = &Dir{
-				fs:      d.fs,
-				buckets: buckets,
-			}
+			isDir = true
 			return nil
 		}
 		if child := b.Get(nameRaw); child != nil {
-			// file
-			n = &File{
-				dir:  d,
-				name: nameRaw,
-			}
 			return nil
 		}
 		return fuse.ENOENT
 	})
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
+	}
+	if isDir {
+		return d.fs.dirNode(d.childPath(nameRaw)), nil
 	}
-	return n, nil
+	return d.fs.fileNode(d, nameRaw), nil
 }
 
 var _ = fs.NodeMkdirer(&Dir{})
 
 func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
-	name, err := DecodeKey(req.Name)
-	if err != nil {
+	if d.fs.readOnly {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	name, err := d.decodeName(req.Name)
+	if err != nil || d.reserved(name) || d.virtualNode(req.Name) != nil {
 		return nil, fuse.EPERM
 	}
+	path := d.childPath(name)
 	err = d.fs.db.Update(func(tx *bolt.Tx) error {
 		b := d.bucket(tx)
 		if b == nil {
-			return errors.New("bucket no longer exists")
+			return errBucketGone
 		}
 		if child := b.Bucket(name); child != nil {
 			return fuse.EEXIST
@@ -157,72 +330,324 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 		if _, err := b.CreateBucket(name); err != nil {
 			return err
 		}
+		if err := d.fs.initMeta(tx, path, req.Mode&^req.Umask, req.Uid, req.Gid); err != nil {
+			return err
+		}
+		if err := d.fs.touch(tx, d.path(), true); err != nil {
+			return err
+		}
 		return nil
 	})
 	if err != nil {
-		return nil, err
-	}
-	buckets := make([][]byte, 0, len(d.buckets)+1)
-	buckets = append(buckets, d.buckets...)
-	buckets = append(buckets, name)
-	n := &Dir{
-		fs:      d.fs,
-		buckets: buckets,
+		return nil, translateError(err)
 	}
-	return n, nil
+	d.fs.statsChanged(path)
+	return d.fs.dirNode(path), nil
 }
 
 var _ = fs.NodeCreater(&Dir{})
 
 func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	if len(d.buckets) == 0 {
+	if d.fs.readOnly {
+		return nil, nil, fuse.Errno(syscall.EROFS)
+	}
+	if len(d.path()) == 0 {
 		// only buckets go in root bucket
 		return nil, nil, fuse.EPERM
 	}
-	nameRaw, err := DecodeKey(req.Name)
-	if err != nil {
+	nameRaw, err := d.decodeName(req.Name)
+	if err != nil || d.virtualNode(req.Name) != nil {
 		return nil, nil, fuse.EPERM
 	}
-	f := &File{
-		dir:     d,
-		name:    nameRaw,
-		writers: 1,
-		// file is empty at Create time, no need to set data
+	f := d.fs.newFileNode(d, nameRaw)
+	h := &writeHandle{
+		file: f,
+		// file is empty at Create time, no need to set data, but
+		// it must be written out even if nothing is written to it
+		dirty: true,
+	}
+	f.mu.Lock()
+	if d.fs.meta {
+		// stored with the key, in the same transaction
+		f.create = &createAttrs{
+			mode: req.Mode &^ req.Umask,
+			uid:  req.Uid,
+			gid:  req.Gid,
+		}
 	}
-	return f, f, nil
+	f.addHandle(h)
+	f.mu.Unlock()
+	return f, h, nil
 }
 
 var _ = fs.NodeRemover(&Dir{})
 
 func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	nameRaw, err := DecodeKey(req.Name)
-	if err != nil {
+	if d.fs.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	if d.virtualNode(req.Name) != nil {
+		return fuse.EPERM
+	}
+	nameRaw, err := d.decodeName(req.Name)
+	if err != nil || d.reserved(nameRaw) {
 		return fuse.ENOENT
 	}
+	path := d.childPath(nameRaw)
+	// as in Rename, a created file may not have been stored yet
+	var file *File
+	if !req.Dir {
+		file = d.fs.cachedFile(path)
+	}
+	var created *writeHandle
+	if file != nil {
+		file.mu.Lock()
+		defer file.mu.Unlock()
+		created = file.createdHandle()
+	}
 	fn := func(tx *bolt.Tx) error {
 		b := d.bucket(tx)
 		if b == nil {
-			return errors.New("bucket no longer exists")
+			return errBucketGone
 		}
 
 		switch req.Dir {
 		case true:
-			if b.Bucket(nameRaw) == nil {
+			child := b.Bucket(nameRaw)
+			if child == nil {
 				return fuse.ENOENT
 			}
+			if !d.fs.recursiveRmdir {
+				if k, _ := child.Cursor().First(); k != nil {
+					return fuse.Errno(syscall.ENOTEMPTY)
+				}
+			}
 			if err := b.DeleteBucket(nameRaw); err != nil {
 				return err
 			}
 
 		case false:
-			if b.Get(nameRaw) == nil {
+			if b.Get(nameRaw) == nil && created == nil {
 				return fuse.ENOENT
 			}
 			if err := b.Delete(nameRaw); err != nil {
 				return err
 			}
 		}
+		if err := d.fs.dropMeta(tx, path); err != nil {
+			return err
+		}
+		if err := d.fs.touch(tx, d.path(), true); err != nil {
+			return err
+		}
 		return nil
 	}
-	return d.fs.db.Update(fn)
+	if err := d.fs.db.Update(fn); err != nil {
+		return translateError(err)
+	}
+	if created != nil {
+		file.unlinked = true
+	}
+	d.fs.removed(path)
+	d.fs.statsChanged(path)
+	return nil
+}
+
+var _ = fs.NodeRenamer(&Dir{})
+
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if d.fs.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	nd, ok := newDir.(*Dir)
+	if !ok {
+		// into a virtual directory
+		return fuse.EPERM
+	}
+	if d.virtualNode(req.OldName) != nil || nd.virtualNode(req.NewName) != nil {
+		return fuse.EPERM
+	}
+	oldName, err := d.decodeName(req.OldName)
+	if err != nil || d.reserved(oldName) {
+		return fuse.ENOENT
+	}
+	newName, err := nd.decodeName(req.NewName)
+	if err != nil || nd.reserved(newName) {
+		return fuse.EPERM
+	}
+	oldPath := d.childPath(oldName)
+	newPath := nd.childPath(newName)
+
+	// A file that has been created is only stored on its first
+	// flush; until then, its key only exists in the buffer of the
+	// handle that created it, and renaming it stores that buffer.
+	file := d.fs.cachedFile(oldPath)
+	var created *writeHandle
+	if file != nil {
+		file.mu.Lock()
+		created = file.createdHandle()
+	}
+	// what was stored from the buffer of created, if anything
+	var fromBuffer []byte
+	fn := func(tx *bolt.Tx) error {
+		src := d.bucket(tx)
+		if src == nil {
+			return errBucketGone
+		}
+		dst := nd.bucket(tx)
+		if dst == nil {
+			return errBucketGone
+		}
+
+		if child := src.Bucket(oldName); child != nil {
+			if sameBuckets(oldPath, newPath) {
+				return nil
+			}
+			if err := renameBucket(src, dst, oldPath, newPath); err != nil {
+				return err
+			}
+		} else {
+			v := src.Get(oldName)
+			pending := v == nil && created != nil
+			if pending {
+				v = created.data
+				if v == nil {
+					// nil would read back as a missing key
+					v = []byte{}
+				}
+			}
+			if v == nil {
+				return fuse.ENOENT
+			}
+			if dst.Bucket(newName) != nil {
+				return fuse.Errno(syscall.EISDIR)
+			}
+			if sameBuckets(oldPath, newPath) {
+				// renaming a key onto itself is a no-op
+				return nil
+			}
+			// Put replaces any existing value at the destination, and the
+			// whole transaction commits atomically.
+			if err := dst.Put(newName, v); err != nil {
+				return err
+			}
+			if err := src.Delete(oldName); err != nil {
+				return err
+			}
+			if pending {
+				fromBuffer = v
+				if file.create != nil {
+					if err := d.fs.createMeta(tx, oldPath, file.create); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if err := d.fs.renameMeta(tx, oldPath, newPath); err != nil {
+			return err
+		}
+		if err := d.fs.touch(tx, newPath, false); err != nil {
+			return err
+		}
+		if err := d.fs.touch(tx, d.path(), true); err != nil {
+			return err
+		}
+		if err := d.fs.touch(tx, nd.path(), true); err != nil {
+			return err
+		}
+		return nil
+	}
+	err = d.fs.db.Update(fn)
+	if file != nil {
+		if err == nil && fromBuffer != nil {
+			created.base = stateOf(fromBuffer)
+			created.dirty = false
+			file.create = nil
+		}
+		// renamed below takes the lock again
+		file.mu.Unlock()
+	}
+	if err != nil {
+		return translateError(err)
+	}
+	if !sameBuckets(oldPath, newPath) {
+		d.fs.renamed(oldPath, newPath, nd)
+		d.fs.statsChanged(oldPath)
+		d.fs.statsChanged(newPath)
+	}
+	return nil
+}
+
+// renameBucket moves the bucket at oldPath, found in src, to newPath
+// in dst. Bolt has no native bucket rename, so the whole tree is
+// copied and the original deleted, inside the caller's transaction.
+func renameBucket(src, dst BucketLike, oldPath, newPath [][]byte) error {
+	oldName := oldPath[len(oldPath)-1]
+	newName := newPath[len(newPath)-1]
+	if len(newPath) > len(oldPath) && sameBuckets(newPath[:len(oldPath)], oldPath) {
+		// cannot move a directory inside itself
+		return fuse.Errno(syscall.EINVAL)
+	}
+
+	if dst.Get(newName) != nil {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	if existing := dst.Bucket(newName); existing != nil {
+		// POSIX allows replacing an empty directory
+		if k, _ := existing.Cursor().First(); k != nil {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		if err := dst.DeleteBucket(newName); err != nil {
+			return err
+		}
+	}
+
+	target, err := dst.CreateBucket(newName)
+	if err != nil {
+		return err
+	}
+	child := src.Bucket(oldName)
+	if child == nil {
+		return errBucketGone
+	}
+	if err := copyBucket(target, child); err != nil {
+		return err
+	}
+	if err := src.DeleteBucket(oldName); err != nil {
+		return err
+	}
+	return nil
+}
+
+// copyBucket recursively copies all keys, nested buckets and
+// sequence numbers of src into dst.
+func copyBucket(dst, src *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	fn := func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		child, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(child, src.Bucket(k))
+	}
+	return src.ForEach(fn)
+}
+
+// sameBuckets reports whether the two bucket paths are identical.
+func sameBuckets(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
 }
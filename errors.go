@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+)
+
+// errBucketGone is returned when the bucket a node refers to has
+// been deleted or renamed since the node was looked up.
+var errBucketGone = errors.New("bucket no longer exists")
+
+// translateError maps errors from Bolt and from bolt-mount itself to
+// the errno the kernel should see. Errors that already carry an
+// errno are passed through, and anything unknown ends up as EIO.
+func translateError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case errBucketGone:
+		return fuse.ESTALE
+	case bolt.ErrBucketNotFound:
+		return fuse.ENOENT
+	case bolt.ErrBucketExists:
+		return fuse.EEXIST
+	case bolt.ErrIncompatibleValue:
+		// a bucket where a key was expected, or the other way around
+		return fuse.EEXIST
+	case bolt.ErrBucketNameRequired, bolt.ErrKeyRequired:
+		return fuse.Errno(syscall.EINVAL)
+	case bolt.ErrKeyTooLarge:
+		return fuse.Errno(syscall.ENAMETOOLONG)
+	case bolt.ErrValueTooLarge:
+		return fuse.Errno(syscall.EFBIG)
+	case bolt.ErrDatabaseReadOnly, bolt.ErrTxNotWritable:
+		return fuse.Errno(syscall.EROFS)
+	}
+	return err
+}
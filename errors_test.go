@@ -0,0 +1,29 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+)
+
+func TestTranslateError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{nil, nil},
+		{errBucketGone, fuse.ESTALE},
+		{bolt.ErrKeyTooLarge, fuse.Errno(syscall.ENAMETOOLONG)},
+		{bolt.ErrValueTooLarge, fuse.Errno(syscall.EFBIG)},
+		{bolt.ErrIncompatibleValue, fuse.EEXIST},
+		{bolt.ErrBucketNameRequired, fuse.Errno(syscall.EINVAL)},
+		{fuse.ENOENT, fuse.ENOENT},
+	}
+	for _, tt := range tests {
+		if g, e := translateError(tt.err), tt.want; g != e {
+			t.Errorf("translateError(%v) = %v, want %v", tt.err, g, e)
+		}
+	}
+}
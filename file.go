@@ -1,30 +1,44 @@
 package main
 
 import (
-	"errors"
+	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"bazil.org/fuse/fuseutil"
 	"github.com/boltdb/bolt"
 	"golang.org/x/net/context"
 )
 
 type File struct {
+	mu sync.Mutex
+	// the bucket and key name; both change when the key is renamed
 	dir  *Dir
 	name []byte
 
-	mu sync.Mutex
-	// number of write-capable handles currently open
-	writers uint
-	// only valid if writers > 0
-	data []byte
+	// write-capable handles currently open
+	handles map[*writeHandle]struct{}
+	// the handle most recently opened or written to, whose buffer
+	// new readers see; nil if there are no write handles
+	latest *writeHandle
+	// the key was removed before it was first stored; buffers are
+	// no longer written anywhere
+	unlinked bool
+	// with metadata storage, the mode and owner the file was
+	// created with, to store along with the key when it is first
+	// stored
+	create *createAttrs
+}
+
+// createAttrs are the mode and owner a file was created with.
+type createAttrs struct {
+	mode     os.FileMode
+	uid, gid uint32
 }
 
 var _ = fs.Node(&File{})
-var _ = fs.Handle(&File{})
 
 // load calls fn inside a View with the contents of the file. Caller
 // must make a copy of the data if needed, because once we're out of
@@ -33,7 +47,7 @@ func (f *File) load(fn func([]byte)) error {
 	err := f.dir.fs.db.View(func(tx *bolt.Tx) error {
 		b := f.dir.bucket(tx)
 		if b == nil {
-			return errors.New("bucket no longer exists")
+			return errBucketGone
 		}
 		v := b.Get(f.name)
 		if v == nil {
@@ -49,140 +63,249 @@ func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	a.Mode = 0644
-	a.Size = uint64(len(f.data))
-	if f.writers == 0 {
+	path := f.dir.childPath(f.name)
+	a.Inode = inode(path)
+	f.dir.fs.defaultAttr(a, 0666)
+	if f.latest != nil {
+		a.Size = uint64(len(f.latest.data))
+	} else {
 		// not in memory, fetch correct size.
-		// Attr can't fail, so ignore errors
-		_ = f.load(func(b []byte) { a.Size = uint64(len(b)) })
+		if err := f.load(func(b []byte) { a.Size = uint64(len(b)) }); err != nil {
+			return translateError(err)
+		}
 	}
+	m, err := f.dir.fs.loadMeta(path)
+	if err != nil {
+		return translateError(err)
+	}
+	if f.create != nil {
+		// not stored yet
+		f.create.fillMeta(&m)
+	}
+	m.fillAttr(a)
 	return nil
 }
 
+var _ = fs.NodeForgetter(&File{})
+
+func (f *File) Forget() {
+	f.mu.Lock()
+	path := f.dir.childPath(f.name)
+	f.mu.Unlock()
+	f.dir.fs.forget(path, f)
+}
+
 var _ = fs.NodeOpener(&File{})
 
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	if req.Flags.IsReadOnly() {
-		// we don't need to track read-only handles
-		return f, nil
-	}
-
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	if f.writers == 0 {
-		// load data
-		fn := func(b []byte) {
-			f.data = append([]byte(nil), b...)
-		}
-		if err := f.load(fn); err != nil {
-			return nil, err
+	atomic.AddUint64(&f.dir.fs.counters.opens, 1)
+	if req.Flags.IsReadOnly() {
+		h, err := f.openRead()
+		if err != nil {
+			return nil, translateError(err)
 		}
+		return h, nil
+	}
+	if f.dir.fs.readOnly {
+		return nil, fuse.Errno(syscall.EROFS)
 	}
 
-	f.writers++
-	return f, nil
+	h := &writeHandle{
+		file: f,
+	}
+	fn := func(b []byte) {
+		h.data = append([]byte(nil), b...)
+		h.base = stateOf(b)
+	}
+	err := f.load(fn)
+	if c := f.createdHandle(); err == fuse.ESTALE && c != nil {
+		// created, but not stored yet; start from its buffer
+		h.data = append([]byte(nil), c.data...)
+		h.base = valueState{}
+		err = nil
+	}
+	if err != nil {
+		return nil, translateError(err)
+	}
+	f.addHandle(h)
+	return h, nil
 }
 
-var _ = fs.HandleReleaser(&File{})
-
-func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	if req.Flags.IsReadOnly() {
-		// we don't need to track read-only handles
-		return nil
+// addHandle registers a new write handle. Caller must hold f.mu.
+func (f *File) addHandle(h *writeHandle) {
+	if f.handles == nil {
+		f.handles = make(map[*writeHandle]struct{})
 	}
+	f.handles[h] = struct{}{}
+	f.latest = h
+	f.dir.fs.trackWriter(h)
+}
 
-	f.mu.Lock()
-	defer f.mu.Unlock()
+// removeHandle is the inverse of addHandle. Caller must hold f.mu.
+func (f *File) removeHandle(h *writeHandle) {
+	delete(f.handles, h)
+	f.dir.fs.untrackWriter(h)
+	if f.latest == h {
+		f.latest = nil
+		for other := range f.handles {
+			f.latest = other
+			break
+		}
+	}
+}
 
-	f.writers--
-	if f.writers == 0 {
-		f.data = nil
+// handleByID returns the write handle the kernel knows as id, or nil
+// if no handle has seen a request with that ID. Caller must hold f.mu.
+func (f *File) handleByID(id fuse.HandleID) *writeHandle {
+	for h := range f.handles {
+		if h.hasID && h.id == id {
+			return h
+		}
 	}
 	return nil
 }
 
-var _ = fs.HandleReader(&File{})
+var _ = fs.NodeFsyncer(&File{})
 
-func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+// Fsync flushes the buffer of the handle it came through. A handle
+// that has not seen a request yet has not been written to, but may
+// have created the file; then buffers like that are flushed, unless
+// that would conflict. Buffers of other writers are never touched.
+func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	fn := func(b []byte) {
-		fuseutil.HandleRead(req, resp, b)
-	}
-	if f.writers == 0 {
-		f.load(fn)
+	filesys := f.dir.fs
+	var handles []*writeHandle
+	resolve := true
+	if h := f.handleByID(req.Handle); h != nil {
+		handles = append(handles, h)
 	} else {
-		fn(f.data)
+		resolve = false
+		for h := range f.handles {
+			if !h.hasID && h.dirty {
+				handles = append(handles, h)
+			}
+		}
 	}
-	return nil
-}
+	f.mu.Unlock()
 
-var _ = fs.HandleWriter(&File{})
+	for _, h := range handles {
+		if err := h.store(resolve); err != nil {
+			return err
+		}
+	}
+	return filesys.sync()
+}
 
-const maxInt = int(^uint(0) >> 1)
+var _ = fs.NodeSetattrer(&File{})
 
-func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// expand the buffer if necessary
-	newLen := req.Offset + int64(len(req.Data))
-	if newLen > int64(maxInt) {
-		return fuse.Errno(syscall.EFBIG)
+	if f.dir.fs.readOnly {
+		return fuse.Errno(syscall.EROFS)
 	}
-	if newLen := int(newLen); newLen > len(f.data) {
-		f.data = append(f.data, make([]byte, newLen-len(f.data))...)
+	path := f.dir.childPath(f.name)
+	if !req.Valid.Size() {
+		return translateError(f.dir.fs.setattrMeta(path, req))
 	}
 
-	n := copy(f.data[req.Offset:], req.Data)
-	resp.Size = n
-	return nil
-}
-
-var _ = fs.HandleFlusher(&File{})
-
-func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	if f.writers == 0 {
-		// Read-only handles also get flushes. Make sure we don't
-		// overwrite valid file contents with a nil buffer.
-		return nil
+	if req.Size > uint64(maxInt) {
+		return fuse.Errno(syscall.EFBIG)
+	}
+	newLen := int(req.Size)
+	if req.Valid.Handle() {
+		if h := f.handleByID(req.Handle); h != nil {
+			// ftruncate(2) only changes the buffer of its handle
+			h.data = resize(h.data, newLen)
+			h.dirty = true
+			f.latest = h
+			return translateError(f.dir.fs.setattrMeta(path, req))
+		}
 	}
 
-	err := f.dir.fs.db.Update(func(tx *bolt.Tx) error {
+	// Not through a handle with a buffer of its own, as in
+	// truncate(2), or O_TRUNC before the new handle has seen a
+	// request; change the stored value directly. Buffers that were
+	// in sync with it follow along, while those with changes of
+	// their own conflict on flush, as with any other change made
+	// elsewhere.
+	var old, stored valueState
+	fn := func(tx *bolt.Tx) error {
 		b := f.dir.bucket(tx)
 		if b == nil {
+			return errBucketGone
+		}
+		v := b.Get(f.name)
+		if v == nil {
 			return fuse.ESTALE
 		}
-		return b.Put(f.name, f.data)
-	})
+		data := resize(append([]byte(nil), v...), newLen)
+		if err := b.Put(f.name, data); err != nil {
+			return err
+		}
+		old = stateOf(v)
+		stored = stateOf(data)
+		return f.dir.fs.applySetattr(tx, path, req)
+	}
+	err := f.dir.fs.db.Update(fn)
+	if err == fuse.ESTALE && f.truncateCreated(newLen) {
+		// not stored yet, as right after creat(2)
+		return translateError(f.dir.fs.setattrMeta(path, req))
+	}
 	if err != nil {
-		return err
+		return translateError(err)
+	}
+	for h := range f.handles {
+		if !h.dirty && h.base == old {
+			h.data = resize(h.data, newLen)
+			h.base = stored
+		}
 	}
 	return nil
 }
 
-var _ = fs.NodeSetattrer(&File{})
-
-func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	if req.Valid.Size() {
-		if req.Size > uint64(maxInt) {
-			return fuse.Errno(syscall.EFBIG)
-		}
-		newLen := int(req.Size)
-		switch {
-		case newLen > len(f.data):
-			f.data = append(f.data, make([]byte, newLen-len(f.data))...)
-		case newLen < len(f.data):
-			f.data = f.data[:newLen]
+// createdHandle returns a handle with the contents of the file, if
+// it has been created but its key has not been stored yet, or nil.
+// The handle that was written to last is preferred. Caller must hold
+// f.mu.
+func (f *File) createdHandle() *writeHandle {
+	if h := f.latest; h != nil && !h.base.exists {
+		return h
+	}
+	for h := range f.handles {
+		if !h.base.exists {
+			return h
 		}
 	}
 	return nil
 }
+
+// truncateCreated resizes the buffers of the handles that created
+// the file, if it has not been stored yet, and reports whether there
+// were any. Caller must hold f.mu.
+func (f *File) truncateCreated(n int) bool {
+	found := false
+	for h := range f.handles {
+		if !h.base.exists {
+			h.data = resize(h.data, n)
+			h.dirty = true
+			found = true
+		}
+	}
+	return found
+}
+
+// resize returns data truncated or zero-extended to n bytes.
+func resize(data []byte, n int) []byte {
+	switch {
+	case n > len(data):
+		data = append(data, make([]byte, n-len(data))...)
+	case n < len(data):
+		data = data[:n]
+	}
+	return data
+}
@@ -1,19 +1,141 @@
 package main
 
 import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"bazil.org/fuse/fs"
 	"github.com/boltdb/bolt"
 )
 
 type FS struct {
+	// first, for 64-bit alignment of the atomic counters
+	counters counters
+
 	db *bolt.DB
+	// path from Bolt database root to the bucket exposed as the
+	// file system root; empty for the whole database
+	root [][]byte
+	// database was opened read-only; all mutations fail with EROFS
+	readOnly bool
+	// store timestamps and other metadata in metaBucket
+	meta bool
+	// owner and umask for nodes without stored metadata
+	uid   uint32
+	gid   uint32
+	umask os.FileMode
+	// if set, rmdir deletes non-empty buckets with all their contents
+	recursiveRmdir bool
+	// if set, flushes that come in together share commits; nil to
+	// commit each on its own
+	batch *groupCommit
+	// read-only opens copy values up to this size, and pin a read
+	// transaction for larger ones, for at most pinMax (0 for no
+	// limit)
+	snapshotMax int
+	pinMax      time.Duration
+	// how long bucket statistics are cached; 0 to compute them on
+	// every use
+	statsTTL time.Duration
+	// maps keys to file names; nil for boltCodec
+	codec KeyCodec
+	// what flushing a write handle does if the value was changed
+	// since the handle was opened
+	onConflict conflictPolicy
+
+	mu sync.Mutex
+	// all open write handles
+	writing map[*writeHandle]struct{}
+	// nodes known to the kernel, see nodes.go
+	nodes map[string]fs.Node
+
+	statsMu    sync.Mutex
+	statsCache map[string]statsEntry
+
+	// the last transaction of update, to count its commit once
+	// however many calls share it; only used inside read-write
+	// transactions, which Bolt runs one at a time
+	lastTx *bolt.Tx
 }
 
 var _ = fs.FS(&FS{})
 
-func (f *FS) Root() (fs.Node, error) {
-	n := &Dir{
-		fs: f,
+// trackWriter records that a write handle is open, so its buffer
+// can be flushed at shutdown.
+func (f *FS) trackWriter(h *writeHandle) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.writing == nil {
+		f.writing = make(map[*writeHandle]struct{})
+	}
+	f.writing[h] = struct{}{}
+}
+
+// untrackWriter is the inverse of trackWriter, called when the
+// handle is released.
+func (f *FS) untrackWriter(h *writeHandle) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.writing, h)
+}
+
+// flushAll writes the buffers of all handles still open for writing
+// to the database. It is used at shutdown, when the kernel may not
+// get to send Flush requests for handles that are still open.
+func (f *FS) flushAll() error {
+	f.mu.Lock()
+	handles := make([]*writeHandle, 0, len(f.writing))
+	for h := range f.writing {
+		handles = append(handles, h)
+	}
+	f.mu.Unlock()
+
+	var firstErr error
+	for _, h := range handles {
+		if err := h.flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return n, nil
+	return firstErr
+}
+
+// update runs fn in a read-write transaction. With group commit
+// enabled, calls that come in while a commit is in progress share the
+// next one, and still return only once their changes are committed;
+// fn may then be called more than once, and must be idempotent.
+func (f *FS) update(fn func(*bolt.Tx) error) error {
+	counted := func(tx *bolt.Tx) error {
+		if tx != f.lastTx {
+			f.lastTx = tx
+			tx.OnCommit(func() { atomic.AddUint64(&f.counters.commits, 1) })
+		}
+		return fn(tx)
+	}
+	if f.batch != nil {
+		return f.batch.update(counted)
+	}
+	return f.db.Update(counted)
+}
+
+// sync forces everything committed so far to stable storage, even
+// when the database is opened with NoSync.
+func (f *FS) sync() error {
+	if f.readOnly {
+		return nil
+	}
+	return translateError(f.db.Sync())
+}
+
+// keyCodec returns the codec for file names.
+func (f *FS) keyCodec() KeyCodec {
+	if f.codec == nil {
+		return boltCodec{}
+	}
+	return f.codec
+}
+
+func (f *FS) Root() (fs.Node, error) {
+	return f.dirNode(f.root), nil
 }
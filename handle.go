@@ -0,0 +1,405 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fuseutil"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+// readHandle is a read-only handle to a File. It sees exactly one
+// version of the value for its whole lifetime, even if the key is
+// changed in the meantime.
+//
+// Values up to FS.snapshotMax are copied at open time. Larger ones
+// are read from a read transaction that stays open until the handle
+// is released, or FS.pinMax passes. Copying them then would make
+// snapshotMax no limit on memory at all, so instead the transaction
+// is closed, and further reads fail with ESTALE; opening the file
+// again gives a new snapshot.
+//
+// A long-lived transaction keeps Bolt from reusing pages, and from
+// growing the database file. A write that needs to grow it holds the
+// Bolt writer lock, and the File.mu it flushes under, while it waits,
+// so everything else soon waits too; hence the limit is short, and
+// the copy limit generous.
+type readHandle struct {
+	fs *FS
+
+	mu sync.Mutex
+	// copy of the value, when not using a pinned transaction
+	data []byte
+	// pinned transaction and the value in it
+	tx    *bolt.Tx
+	value []byte
+	timer *time.Timer
+	// the pinned transaction was closed after FS.pinMax
+	expired bool
+}
+
+// openRead returns a new read-only handle for f. Caller must hold
+// f.mu.
+func (f *File) openRead() (*readHandle, error) {
+	if f.latest != nil {
+		// unflushed writes are visible to readers
+		h := &readHandle{
+			fs:   f.dir.fs,
+			data: append([]byte(nil), f.latest.data...),
+		}
+		return h, nil
+	}
+
+	filesys := f.dir.fs
+	tx, err := filesys.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	b := f.dir.bucket(tx)
+	if b == nil {
+		_ = tx.Rollback()
+		return nil, errBucketGone
+	}
+	v := b.Get(f.name)
+	if v == nil {
+		_ = tx.Rollback()
+		return nil, fuse.ESTALE
+	}
+	if len(v) <= filesys.snapshotMax {
+		h := &readHandle{
+			fs:   filesys,
+			data: append([]byte(nil), v...),
+		}
+		_ = tx.Rollback()
+		return h, nil
+	}
+
+	h := &readHandle{
+		fs:    filesys,
+		tx:    tx,
+		value: v,
+	}
+	if filesys.pinMax > 0 {
+		h.timer = time.AfterFunc(filesys.pinMax, h.expire)
+	}
+	return h, nil
+}
+
+// expire closes the pinned transaction early. The value is larger
+// than FS.snapshotMax, so it is not copied, and reads still to come
+// fail.
+func (h *readHandle) expire() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tx != nil {
+		_ = h.tx.Rollback()
+		h.tx = nil
+		h.value = nil
+		h.expired = true
+	}
+}
+
+var _ = fs.HandleReader(&readHandle{})
+
+func (h *readHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	atomic.AddUint64(&h.fs.counters.reads, 1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.expired {
+		return fuse.ESTALE
+	}
+	if h.tx != nil {
+		fuseutil.HandleRead(req, resp, h.value)
+	} else {
+		fuseutil.HandleRead(req, resp, h.data)
+	}
+	return nil
+}
+
+var _ = fs.HandleReleaser(&readHandle{})
+
+func (h *readHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	if h.tx != nil {
+		_ = h.tx.Rollback()
+		h.tx = nil
+		h.value = nil
+	}
+	h.data = nil
+	return nil
+}
+
+// conflictPolicy decides what flushing a write handle does when the
+// value in the database has changed since the handle last saw it.
+type conflictPolicy int
+
+const (
+	// fail the flush with ESTALE
+	conflictStale conflictPolicy = iota
+	// fail the flush with EAGAIN
+	conflictAgain
+	// keep the database value, and save the buffer under a new
+	// key next to it
+	conflictCopy
+)
+
+var conflictPolicies = []string{
+	conflictStale: "estale",
+	conflictAgain: "eagain",
+	conflictCopy:  "copy",
+}
+
+func (p *conflictPolicy) String() string {
+	return conflictPolicies[*p]
+}
+
+func (p *conflictPolicy) Set(s string) error {
+	for i, name := range conflictPolicies {
+		if s == name {
+			*p = conflictPolicy(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown conflict policy %q, want one of %v", s, conflictPolicies)
+}
+
+// writeHandle is a write-capable handle to a File. Every handle has
+// a buffer of its own, which is written to the database on Flush.
+//
+// To avoid silently overwriting changes made elsewhere since the
+// handle was opened, Flush only writes if the database still holds
+// the value the handle started from; otherwise FS.onConflict
+// decides what happens.
+type writeHandle struct {
+	file *File
+
+	// fields below are guarded by file.mu
+	data []byte
+	// data has changes not yet written to the database
+	dirty bool
+	// the database value the buffer was last in sync with
+	base valueState
+	// the ID the kernel knows the handle by, once a request that
+	// carries it has come in; Fsync and Setattr go to the node,
+	// and only have the ID to tell which handle they are for
+	id    fuse.HandleID
+	hasID bool
+}
+
+// learnID records the ID of h from a request on it. Caller must hold
+// file.mu.
+func (h *writeHandle) learnID(id fuse.HandleID) {
+	h.id = id
+	h.hasID = true
+}
+
+// valueState identifies a version of a value, without keeping a
+// copy of it.
+type valueState struct {
+	exists bool
+	sum    [sha256.Size]byte
+}
+
+// stateOf returns the state of the value v, as returned by Get; nil
+// means the key does not exist.
+func stateOf(v []byte) valueState {
+	if v == nil {
+		return valueState{}
+	}
+	return valueState{exists: true, sum: sha256.Sum256(v)}
+}
+
+var _ = fs.HandleReader(&writeHandle{})
+
+func (h *writeHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+
+	h.learnID(req.Handle)
+	atomic.AddUint64(&h.file.dir.fs.counters.reads, 1)
+	fuseutil.HandleRead(req, resp, h.data)
+	return nil
+}
+
+var _ = fs.HandleWriter(&writeHandle{})
+
+const maxInt = int(^uint(0) >> 1)
+
+func (h *writeHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	f := h.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.dir.fs.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	h.learnID(req.Handle)
+	atomic.AddUint64(&f.dir.fs.counters.writes, 1)
+
+	// expand the buffer if necessary
+	newLen := req.Offset + int64(len(req.Data))
+	if newLen > int64(maxInt) {
+		return fuse.Errno(syscall.EFBIG)
+	}
+	if newLen := int(newLen); newLen > len(h.data) {
+		h.data = append(h.data, make([]byte, newLen-len(h.data))...)
+	}
+
+	n := copy(h.data[req.Offset:], req.Data)
+	resp.Size = n
+	h.dirty = true
+	f.latest = h
+	return nil
+}
+
+var _ = fs.HandleFlusher(&writeHandle{})
+
+func (h *writeHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	h.file.mu.Lock()
+	h.learnID(req.Handle)
+	h.file.mu.Unlock()
+	return h.flush()
+}
+
+// flush writes the buffer to the database, if it has changed.
+func (h *writeHandle) flush() error {
+	return h.store(true)
+}
+
+// store is flush. If the value in the database has changed since
+// the buffer was last in sync with it, FS.onConflict decides what
+// happens if resolve is set; otherwise the buffer is left dirty, to
+// be dealt with when its own handle is flushed.
+func (h *writeHandle) store(resolve bool) error {
+	f := h.file
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.dir.fs.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	if !h.dirty || f.unlinked {
+		atomic.AddUint64(&f.dir.fs.counters.flushesSkipped, 1)
+		return nil
+	}
+
+	data := h.data
+	if data == nil {
+		// nil would read back as a missing key within the transaction
+		data = []byte{}
+	}
+	// what the database holds after a successful commit
+	var stored valueState
+	var conflict, skipped, added bool
+	fn := func(tx *bolt.Tx) error {
+		conflict = false
+		skipped = false
+		added = false
+		b := f.dir.bucket(tx)
+		if b == nil {
+			return errBucketGone
+		}
+		v := b.Get(f.name)
+		if stateOf(v) != h.base {
+			if !resolve {
+				skipped = true
+				return nil
+			}
+			conflict = true
+			switch f.dir.fs.onConflict {
+			case conflictAgain:
+				return fuse.Errno(syscall.EAGAIN)
+			case conflictCopy:
+				stored = stateOf(v)
+				added = true
+				return f.saveConflict(tx, b, data)
+			default:
+				return fuse.ESTALE
+			}
+		}
+
+		if err := b.Put(f.name, data); err != nil {
+			return err
+		}
+		stored = stateOf(data)
+		if v == nil && f.create != nil {
+			if err := f.dir.fs.createMeta(tx, f.dir.childPath(f.name), f.create); err != nil {
+				return err
+			}
+		}
+		if err := f.dir.fs.touch(tx, f.dir.childPath(f.name), true); err != nil {
+			return err
+		}
+		if v == nil {
+			// new directory entry
+			added = true
+			if err := f.dir.fs.touch(tx, f.dir.path(), true); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := f.dir.fs.update(fn)
+	if conflict {
+		atomic.AddUint64(&f.dir.fs.counters.conflicts, 1)
+	}
+	if err != nil {
+		return translateError(err)
+	}
+	if added {
+		// the same parent, whichever key was added
+		f.dir.fs.statsChanged(f.dir.childPath(f.name))
+	}
+	if skipped {
+		return nil
+	}
+	atomic.AddUint64(&f.dir.fs.counters.flushes, 1)
+	h.base = stored
+	h.dirty = false
+	f.create = nil
+	return nil
+}
+
+// saveConflict stores data, which conflicts with the current value
+// of f, under a new key next to it.
+func (f *File) saveConflict(tx *bolt.Tx, b BucketLike, data []byte) error {
+	name := append([]byte(nil), f.name...)
+	name = append(name, fmt.Sprintf(".conflict-%d", time.Now().UnixNano())...)
+	if err := b.Put(name, data); err != nil {
+		return err
+	}
+	if err := f.dir.fs.touch(tx, f.dir.childPath(name), true); err != nil {
+		return err
+	}
+	if err := f.dir.fs.touch(tx, f.dir.path(), true); err != nil {
+		return err
+	}
+	filesys := f.dir.fs
+	log.Printf("conflicting write to %s saved as %s", filesys.displayPath(tx, f.dir.childPath(f.name)), filesys.displayPath(tx, f.dir.childPath(name)))
+	return nil
+}
+
+var _ = fs.HandleReleaser(&writeHandle{})
+
+func (h *writeHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+
+	h.file.removeHandle(h)
+	h.data = nil
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+func readAll(t testing.TB, h *readHandle) (string, error) {
+	req := &fuse.ReadRequest{Size: 4096}
+	resp := &fuse.ReadResponse{Data: make([]byte, 0, req.Size)}
+	if err := h.Read(context.Background(), req, resp); err != nil {
+		return "", err
+	}
+	return string(resp.Data), nil
+}
+
+func testReadSnapshot(t *testing.T, filesys *FS, pinned bool) {
+	tmp, err := ioutil.TempDir("", "bolt-mount-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	// room to grow without remapping, which would wait for the
+	// pinned transaction
+	db, err := bolt.Open(filepath.Join(tmp, "db"), 0600, &bolt.Options{InitialMmapSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	filesys.db = db
+	put := func(value string) {
+		fn := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("greeting"), []byte(value))
+		}
+		if err := db.Update(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("hello")
+
+	f := &File{
+		dir:  &Dir{fs: filesys, buckets: [][]byte{[]byte("bukkit")}},
+		name: []byte("greeting"),
+	}
+	h, err := f.openRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Release(context.Background(), &fuse.ReleaseRequest{})
+	if g, e := h.tx != nil, pinned; g != e {
+		t.Fatalf("wrong pinning: %v != %v", g, e)
+	}
+
+	put("changed")
+	data, err := readAll(t, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := data, "hello"; g != e {
+		t.Errorf("snapshot changed: %q != %q", g, e)
+	}
+}
+
+func TestReadSnapshotCopy(t *testing.T) {
+	testReadSnapshot(t, &FS{snapshotMax: 1024}, false)
+}
+
+func TestReadSnapshotPinned(t *testing.T) {
+	testReadSnapshot(t, &FS{}, true)
+}
+
+func TestReadSnapshotExpired(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		fn := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("greeting"), []byte("hello"))
+		}
+		if err := db.Update(fn); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{
+			db: db,
+			// expired by hand below
+			pinMax: time.Hour,
+		}
+		f := &File{
+			dir:  &Dir{fs: filesys, buckets: [][]byte{[]byte("bukkit")}},
+			name: []byte("greeting"),
+		}
+		h, err := f.openRead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Release(context.Background(), &fuse.ReleaseRequest{})
+		pinned := func() bool {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			return h.tx != nil
+		}
+		if !pinned() {
+			t.Fatal("expected a pinned transaction")
+		}
+		if h.timer == nil {
+			t.Fatal("expected an expiry timer")
+		}
+		h.expire()
+		if pinned() {
+			t.Fatal("expected the transaction to be closed")
+		}
+		// too large to copy, so it is gone
+		if _, err := readAll(t, h); err != fuse.ESTALE {
+			t.Errorf("expected ESTALE after expiry, got %v", err)
+		}
+	})
+}
+
+func TestConflictPolicyFlag(t *testing.T) {
+	var p conflictPolicy
+	if g, e := p.String(), "estale"; g != e {
+		t.Errorf("wrong default: %q != %q", g, e)
+	}
+	if err := p.Set("copy"); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := p, conflictCopy; g != e {
+		t.Errorf("wrong policy: %v != %v", g, e)
+	}
+	if err := p.Set("bogus"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestWriteHandleConflict(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		put := func(value string) {
+			fn := func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucketIfNotExists([]byte("bukkit"))
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte("greeting"), []byte(value))
+			}
+			if err := db.Update(fn); err != nil {
+				t.Fatal(err)
+			}
+		}
+		put("hello")
+
+		filesys := &FS{db: db}
+		f := &File{
+			dir:  &Dir{fs: filesys, buckets: [][]byte{[]byte("bukkit")}},
+			name: []byte("greeting"),
+		}
+		ctx := context.Background()
+		open := func() *writeHandle {
+			h, err := f.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return h.(*writeHandle)
+		}
+		write := func(h *writeHandle, s string) {
+			req := &fuse.WriteRequest{Data: []byte(s)}
+			if err := h.Write(ctx, req, &fuse.WriteResponse{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		h := open()
+		write(h, "J")
+		if err := h.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatalf("flush without conflict: %v", err)
+		}
+		// the handle is in sync with its own write now
+		write(h, "H")
+		if err := h.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatalf("second flush: %v", err)
+		}
+
+		put("external")
+		write(h, "X")
+		if err := h.Flush(ctx, &fuse.FlushRequest{}); err != fuse.ESTALE {
+			t.Fatalf("expected ESTALE, got %v", err)
+		}
+		if err := h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		if len(f.handles) != 0 || f.latest != nil {
+			t.Errorf("handle not released")
+		}
+	})
+}
+
+func TestCreatedBeforeFlush(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("target"), []byte("old"))
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		filesys := &FS{db: db}
+		d := filesys.dirNode([][]byte{[]byte("bukkit")})
+		create := func(name string) *writeHandle {
+			_, h, err := d.Create(ctx, &fuse.CreateRequest{Name: name, Mode: 0644}, &fuse.CreateResponse{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wh := h.(*writeHandle)
+			req := &fuse.WriteRequest{Data: []byte("new")}
+			if err := wh.Write(ctx, req, &fuse.WriteResponse{}); err != nil {
+				t.Fatal(err)
+			}
+			return wh
+		}
+		get := func(name string) []byte {
+			var v []byte
+			fn := func(tx *bolt.Tx) error {
+				if got := tx.Bucket([]byte("bukkit")).Get([]byte(name)); got != nil {
+					v = append([]byte{}, got...)
+				}
+				return nil
+			}
+			if err := db.View(fn); err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+
+		// write a temporary file and rename it over the original
+		// before closing it
+		h := create("tmp123")
+		req := &fuse.RenameRequest{OldName: "tmp123", NewName: "target"}
+		if err := d.Rename(ctx, req, d); err != nil {
+			t.Fatalf("rename before flush: %v", err)
+		}
+		if err := h.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatalf("flush after rename: %v", err)
+		}
+		if g, e := string(get("target")), "new"; g != e {
+			t.Errorf("wrong content after rename: %q != %q", g, e)
+		}
+		if v := get("tmp123"); v != nil {
+			t.Errorf("old name written back: %q", v)
+		}
+
+		// unlink before closing
+		h = create("scratch")
+		if err := d.Remove(ctx, &fuse.RemoveRequest{Name: "scratch"}); err != nil {
+			t.Fatalf("remove before flush: %v", err)
+		}
+		if err := h.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatalf("flush after remove: %v", err)
+		}
+		if v := get("scratch"); v != nil {
+			t.Errorf("removed file written back: %q", v)
+		}
+	})
+}
+
+func TestOpenCreatedBeforeFlush(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("bukkit"))
+			return err
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		filesys := &FS{db: db}
+		d := filesys.dirNode([][]byte{[]byte("bukkit")})
+		n, h, err := d.Create(ctx, &fuse.CreateRequest{Name: "x", Mode: 0644}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &fuse.WriteRequest{Data: []byte("hello")}
+		if err := h.(*writeHandle).Write(ctx, req, &fuse.WriteResponse{}); err != nil {
+			t.Fatal(err)
+		}
+
+		h2, err := n.(*File).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatalf("writable open before flush: %v", err)
+		}
+		if g, e := string(h2.(*writeHandle).data), "hello"; g != e {
+			t.Errorf("wrong buffer: %q != %q", g, e)
+		}
+		if err := h.(*writeHandle).Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		// the second handle made no changes of its own
+		if err := h2.(*writeHandle).Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Errorf("flush of second handle: %v", err)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A keyFormat is a KeyCodec for buckets whose keys all have the same
+// shape, set as a hint in the metadata of the bucket. Keys that do
+// not fit the format are shown as "@" and their hex encoding, which
+// no formatted name starts with.
+type keyFormat struct {
+	// format returns the name for key, or false if the key does not
+	// have the right shape
+	format func(key []byte) (string, bool)
+	// parse is the inverse of format
+	parse func(name string) ([]byte, error)
+}
+
+// keyFormats are the formats that can be set with the
+// user.bolt.keyformat extended attribute of a directory.
+var keyFormats = map[string]keyFormat{
+	"uint64be": {
+		format: func(key []byte) (string, bool) {
+			if len(key) != 8 {
+				return "", false
+			}
+			return strconv.FormatUint(binary.BigEndian.Uint64(key), 10), true
+		},
+		parse: func(name string) ([]byte, error) {
+			n, err := strconv.ParseUint(name, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, n)
+			return key, nil
+		},
+	},
+	"int64be": {
+		format: func(key []byte) (string, bool) {
+			if len(key) != 8 {
+				return "", false
+			}
+			return strconv.FormatInt(int64(binary.BigEndian.Uint64(key)), 10), true
+		},
+		parse: func(name string) ([]byte, error) {
+			n, err := strconv.ParseInt(name, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(n))
+			return key, nil
+		},
+	},
+	"uuid": {
+		format: func(key []byte) (string, bool) {
+			if len(key) != 16 {
+				return "", false
+			}
+			s := hex.EncodeToString(key)
+			return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:], true
+		},
+		parse: func(name string) ([]byte, error) {
+			if len(name) != 36 {
+				return nil, fmt.Errorf("not a UUID: %q", name)
+			}
+			return hex.DecodeString(strings.Replace(name, "-", "", 4))
+		},
+	},
+	"unix-nanos": {
+		format: func(key []byte) (string, bool) {
+			if len(key) != 8 {
+				return "", false
+			}
+			t := time.Unix(0, int64(binary.BigEndian.Uint64(key))).UTC()
+			return t.Format(time.RFC3339Nano), true
+		},
+		parse: func(name string) ([]byte, error) {
+			t, err := time.Parse(time.RFC3339Nano, name)
+			if err != nil {
+				return nil, err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+			return key, nil
+		},
+	},
+	"utf8": {
+		format: func(key []byte) (string, bool) {
+			if !utf8.Valid(key) {
+				return "", false
+			}
+			s := string(key)
+			if strings.ContainsAny(s, "/\x00") || strings.HasPrefix(s, ".") || strings.HasPrefix(s, "@") {
+				return "", false
+			}
+			return s, true
+		},
+		parse: func(name string) ([]byte, error) {
+			return []byte(name), nil
+		},
+	},
+}
+
+// keyFormatNames returns the names of all key formats, sorted.
+func keyFormatNames() []string {
+	names := make([]string, 0, len(keyFormats))
+	for name := range keyFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var _ = KeyCodec(keyFormat{})
+
+func (k keyFormat) Encode(key []byte) (string, error) {
+	if name, ok := k.format(key); ok {
+		return checkLen(name)
+	}
+	return checkLen("@" + hex.EncodeToString(key))
+}
+
+func (k keyFormat) Decode(name string) ([]byte, error) {
+	var key []byte
+	var err error
+	if strings.HasPrefix(name, "@") {
+		key, err = hex.DecodeString(name[1:])
+	} else {
+		key, err = k.parse(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// only one name per key, so lookups agree with listings; this
+	// also rejects hex names for keys that fit the format
+	if enc, err := k.Encode(key); err != nil || enc != name {
+		return nil, fmt.Errorf("not a canonical name: %q", name)
+	}
+	return key, nil
+}
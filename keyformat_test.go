@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+func TestKeyFormats(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		key    []byte
+		name   string
+	}{
+		{"uint64be", []byte{0, 0, 0, 0, 0, 0, 0, 42}, "42"},
+		{"uint64be", []byte{42}, "@2a"},
+		{"int64be", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, "-2"},
+		{"uuid", []byte("\x12\x34\x56\x78\x9a\xbc\xde\xf0\x12\x34\x56\x78\x9a\xbc\xde\xf0"), "12345678-9abc-def0-1234-56789abcdef0"},
+		{"unix-nanos", []byte{0x16, 0x55, 0xf2, 0x9d, 0x78, 0x7c, 0x00, 0x00}, "2021-01-01T00:00:00Z"},
+		{"utf8", []byte("héllo wörld"), "héllo wörld"},
+		{"utf8", []byte(".hidden"), "@2e68696464656e"},
+		{"utf8", []byte("a/b"), "@612f62"},
+		{"utf8", []byte{0xff}, "@ff"},
+	} {
+		k := keyFormats[tc.format]
+		name, err := k.Encode(tc.key)
+		if err != nil {
+			t.Errorf("%s: encode %x: %v", tc.format, tc.key, err)
+			continue
+		}
+		if g, e := name, tc.name; g != e {
+			t.Errorf("%s: wrong name for %x: %q != %q", tc.format, tc.key, g, e)
+		}
+		key, err := k.Decode(name)
+		if err != nil {
+			t.Errorf("%s: decode %q: %v", tc.format, name, err)
+			continue
+		}
+		if !bytes.Equal(key, tc.key) {
+			t.Errorf("%s: wrong key for %q: %x != %x", tc.format, name, key, tc.key)
+		}
+	}
+}
+
+func TestKeyFormatNonCanonical(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		name   string
+	}{
+		{"uint64be", "042"},
+		{"uint64be", "+42"},
+		{"uint64be", "@000000000000002a"},
+		{"uuid", "12345678-9ABC-DEF0-1234-56789ABCDEF0"},
+		{"unix-nanos", "2021-01-01T01:00:00+01:00"},
+	} {
+		if _, err := keyFormats[tc.format].Decode(tc.name); err == nil {
+			t.Errorf("%s: %q decoded without error", tc.format, tc.name)
+		}
+	}
+}
+
+func TestKeyFormatHint(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte{0, 0, 0, 0, 0, 0, 0, 42}, []byte("x")); err != nil {
+				return err
+			}
+			return b.Put([]byte("odd"), []byte("y"))
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		filesys := &FS{db: db, meta: true}
+		d := filesys.dirNode([][]byte{[]byte("bukkit")})
+		req := &fuse.SetxattrRequest{Name: keyFormatXattr, Xattr: []byte("roman")}
+		if err := d.Setxattr(ctx, req); err != fuse.Errno(syscall.EINVAL) {
+			t.Errorf("expected EINVAL for unknown format, got %v", err)
+		}
+		req = &fuse.SetxattrRequest{Name: keyFormatXattr, Xattr: []byte("uint64be")}
+		if err := d.Setxattr(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+
+		dirs, err := d.ReadDirAll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, de := range dirs {
+			names = append(names, de.Name)
+		}
+		// still in key order
+		if g, e := names, []string{"42", "@6f6464"}; !reflect.DeepEqual(g, e) {
+			t.Errorf("wrong listing: %q != %q", g, e)
+		}
+
+		if _, err := d.Lookup(ctx, "42"); err != nil {
+			t.Errorf("lookup of formatted name: %v", err)
+		}
+		creq := &fuse.CreateRequest{Name: "7", Mode: 0644}
+		_, h, err := d.Create(ctx, creq, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.(*writeHandle).Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		check := func(tx *bolt.Tx) error {
+			if v := tx.Bucket([]byte("bukkit")).Get([]byte{0, 0, 0, 0, 0, 0, 0, 7}); v == nil {
+				t.Errorf("created key not stored in format")
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestDisplayPath(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		key := []byte{0, 0, 0, 0, 0, 0, 0, 42}
+		prep := func(tx *bolt.Tx) error {
+			app, err := tx.CreateBucket([]byte("app"))
+			if err != nil {
+				return err
+			}
+			ids, err := app.CreateBucket([]byte("ids"))
+			if err != nil {
+				return err
+			}
+			return ids.Put(key, []byte("x"))
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		filesys := &FS{
+			db:    db,
+			root:  [][]byte{[]byte("app")},
+			meta:  true,
+			codec: hexCodec{},
+		}
+		d := filesys.dirNode([][]byte{[]byte("app"), []byte("ids")})
+		req := &fuse.SetxattrRequest{Name: keyFormatXattr, Xattr: []byte("uint64be")}
+		if err := d.Setxattr(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+		check := func(tx *bolt.Tx) error {
+			if g, e := filesys.displayPath(tx, d.childPath(key)), "/696473/42"; g != e {
+				t.Errorf("wrong path: %q != %q", g, e)
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
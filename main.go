@@ -6,6 +6,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
 )
 
 var progName = filepath.Base(os.Args[0])
@@ -14,15 +19,55 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", progName)
 	fmt.Fprintf(os.Stderr, "  %s DBPATH MOUNTPOINT\n", progName)
 	fmt.Fprintf(os.Stderr, "\n")
-	fmt.Fprintf(os.Stderr, "  DBPATH will be created if it does not exist.\n")
+	fmt.Fprintf(os.Stderr, "  DBPATH will be created if it does not exist, unless -ro is given.\n")
 	fmt.Fprintf(os.Stderr, "\n")
 	flag.PrintDefaults()
 }
 
+// octalFlag is a flag.Value for numbers conventionally written in
+// octal, like umasks.
+type octalFlag uint
+
+func (o *octalFlag) String() string {
+	return fmt.Sprintf("%#o", uint(*o))
+}
+
+func (o *octalFlag) Set(s string) error {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return err
+	}
+	*o = octalFlag(n)
+	return nil
+}
+
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix(progName + ": ")
 
+	var opts mountOptions
+	flag.BoolVar(&opts.readOnly, "ro", false, "open the database read-only and mount the file system read-only")
+	flag.StringVar(&opts.root, "root", "", "slash-separated path of encoded bucket names to mount instead of the whole database")
+	flag.StringVar(&opts.encoding, "encoding", "bolt", "how keys are shown as file names: "+strings.Join(codecNames(), ", "))
+	flag.BoolVar(&opts.createRoot, "create-root", false, "create the -root bucket path if it does not exist")
+	flag.BoolVar(&opts.meta, "meta", false, "store timestamps, modes and owners in a hidden bucket")
+	flag.UintVar(&opts.uid, "uid", uint(os.Getuid()), "owner of files and directories without stored metadata")
+	flag.UintVar(&opts.gid, "gid", uint(os.Getgid()), "group of files and directories without stored metadata")
+	opts.umask = 022
+	flag.Var((*octalFlag)(&opts.umask), "umask", "umask applied to files and directories without stored metadata")
+	flag.BoolVar(&opts.noSync, "nosync", false, "do not fsync the database after every commit, only on fsync(2); unsafe on crash")
+	flag.BoolVar(&opts.noGrowSync, "nogrowsync", false, "do not fsync the database when growing the file")
+	flag.IntVar(&opts.mmapFlags, "mmapflags", 0, "extra flags for mmap(2) of the database, as a number, e.g. 0x8000 for MAP_POPULATE on Linux")
+	flag.BoolVar(&opts.batch, "batch", false, "let writes of files closed while another is being committed share the next commit; a write on its own commits right away")
+	flag.DurationVar(&opts.batchDelay, "batch-delay", 0, "with -batch, how long a commit that writes are already waiting for waits for more to join it")
+	flag.IntVar(&opts.batchSize, "batch-size", bolt.DefaultMaxBatchSize, "with -batch, most writes to group in one commit")
+	flag.IntVar(&opts.snapshotMax, "snapshot-max", 16<<20, "read-only opens copy values up to this many bytes, and pin a read transaction for larger ones")
+	flag.DurationVar(&opts.pinMax, "pin-max", 5*time.Second, "longest time a read handle may pin a transaction, after which reads of it fail with ESTALE; 0 for no limit")
+	flag.DurationVar(&opts.statsTTL, "stats-ttl", time.Second, "how long to cache bucket statistics used for directory sizes and statfs")
+	flag.Var(&opts.onConflict, "on-conflict", "when a file changed since it was opened for writing, fail close with \"estale\" or \"eagain\", or save a conflict \"copy\"")
+	flag.BoolVar(&opts.verbose, "v", false, "log diagnostic counters at shutdown")
+	flag.BoolVar(&opts.recursiveRmdir, "rmdir-recursive", false, "let rmdir delete non-empty buckets and everything in them")
+
 	flag.Usage = usage
 	flag.Parse()
 
@@ -31,7 +76,7 @@ func main() {
 		os.Exit(2)
 	}
 
-	err := mount(flag.Arg(0), flag.Arg(1))
+	err := mount(flag.Arg(0), flag.Arg(1), &opts)
 	if err != nil {
 		log.Fatal(err)
 	}
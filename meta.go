@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+)
+
+// metaBucket is a reserved bucket in the root of the database that
+// holds metadata about the other keys and buckets, when metadata
+// storage is enabled. It is never shown in the file system.
+//
+// Records are keyed by metaKey of the raw path of the node they
+// describe, and contain a JSON-encoded metadata value.
+var metaBucket = []byte("\x00bolt-mount-meta")
+
+type metadata struct {
+	Mtime time.Time `json:"mtime"`
+	Ctime time.Time `json:"ctime"`
+	// nil when not set, to use the mount defaults
+	Mode *os.FileMode `json:"mode,omitempty"`
+	Uid  *uint32      `json:"uid,omitempty"`
+	Gid  *uint32      `json:"gid,omitempty"`
+	// extended attributes set by the user
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+	// for buckets, the name of the keyFormat of the keys inside
+	KeyFormat string `json:"keyformat,omitempty"`
+}
+
+// fillAttr copies the stored metadata into a, leaving the defaults
+// already there for anything not stored.
+func (m *metadata) fillAttr(a *fuse.Attr) {
+	if !m.Mtime.IsZero() {
+		a.Mtime = m.Mtime
+		a.Atime = m.Mtime
+	}
+	if !m.Ctime.IsZero() {
+		a.Ctime = m.Ctime
+	}
+	if m.Mode != nil {
+		a.Mode = a.Mode&^os.ModePerm | *m.Mode&os.ModePerm
+	}
+	if m.Uid != nil {
+		a.Uid = *m.Uid
+	}
+	if m.Gid != nil {
+		a.Gid = *m.Gid
+	}
+}
+
+// defaultAttr fills in the mode and owner used for nodes without
+// stored metadata. perm is the mode before applying the umask.
+func (f *FS) defaultAttr(a *fuse.Attr, perm os.FileMode) {
+	a.Mode = a.Mode&^os.ModePerm | perm&^f.umask
+	a.Uid = f.uid
+	a.Gid = f.gid
+}
+
+// metaKey encodes a raw path of bucket names (and possibly a final
+// key name) into a key for metaBucket.
+//
+// Every path segment is prefixed with its length, so the key of a
+// bucket is a prefix of the keys of everything inside it, and no
+// other key has that prefix. A leading zero byte keeps the key for
+// the root non-empty.
+func metaKey(path [][]byte) []byte {
+	key := []byte{0}
+	var buf [binary.MaxVarintLen64]byte
+	for _, seg := range path {
+		n := binary.PutUvarint(buf[:], uint64(len(seg)))
+		key = append(key, buf[:n]...)
+		key = append(key, seg...)
+	}
+	return key
+}
+
+// getMeta returns the metadata stored for path, or a zero value if
+// there is none.
+func getMeta(tx *bolt.Tx, path [][]byte) (metadata, error) {
+	var m metadata
+	b := tx.Bucket(metaBucket)
+	if b == nil {
+		return m, nil
+	}
+	v := b.Get(metaKey(path))
+	if v == nil {
+		return m, nil
+	}
+	if err := json.Unmarshal(v, &m); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+func putMeta(tx *bolt.Tx, path [][]byte, m metadata) error {
+	b, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return b.Put(metaKey(path), v)
+}
+
+// metaKeysUnder returns copies of all keys in metaBucket for path
+// and everything below it.
+func metaKeysUnder(b *bolt.Bucket, path [][]byte) [][]byte {
+	prefix := metaKey(path)
+	var keys [][]byte
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	return keys
+}
+
+// deleteMeta removes the metadata for path and, if it is a bucket,
+// for everything inside it.
+func deleteMeta(tx *bolt.Tx, path [][]byte) error {
+	b := tx.Bucket(metaBucket)
+	if b == nil {
+		return nil
+	}
+	for _, k := range metaKeysUnder(b, path) {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveMeta moves the metadata for oldPath, and everything inside
+// it, to newPath. Any metadata already at newPath is replaced.
+func moveMeta(tx *bolt.Tx, oldPath, newPath [][]byte) error {
+	if err := deleteMeta(tx, newPath); err != nil {
+		return err
+	}
+	b := tx.Bucket(metaBucket)
+	if b == nil {
+		return nil
+	}
+	oldPrefix := metaKey(oldPath)
+	newPrefix := metaKey(newPath)
+	for _, k := range metaKeysUnder(b, oldPath) {
+		v := append([]byte(nil), b.Get(k)...)
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+		nk := append(append([]byte(nil), newPrefix...), k[len(oldPrefix):]...)
+		if err := b.Put(nk, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMeta returns the metadata for path, or a zero value when
+// metadata storage is disabled.
+func (f *FS) loadMeta(path [][]byte) (metadata, error) {
+	var m metadata
+	if !f.meta {
+		return m, nil
+	}
+	err := f.db.View(func(tx *bolt.Tx) error {
+		var err error
+		m, err = getMeta(tx, path)
+		return err
+	})
+	return m, err
+}
+
+// touch records a change to path at the current time. The ctime is
+// always updated; the mtime only if the contents were modified.
+func (f *FS) touch(tx *bolt.Tx, path [][]byte, modified bool) error {
+	if !f.meta {
+		return nil
+	}
+	m, err := getMeta(tx, path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	m.Ctime = now
+	if modified {
+		m.Mtime = now
+	}
+	return putMeta(tx, path, m)
+}
+
+// initMeta stores the mode and owner of a newly created node.
+func (f *FS) initMeta(tx *bolt.Tx, path [][]byte, mode os.FileMode, uid, gid uint32) error {
+	if !f.meta {
+		return nil
+	}
+	now := time.Now()
+	mode &= os.ModePerm
+	m := metadata{
+		Mtime: now,
+		Ctime: now,
+		Mode:  &mode,
+		Uid:   &uid,
+		Gid:   &gid,
+	}
+	return putMeta(tx, path, m)
+}
+
+// createMeta stores the mode and owner of a newly created file, when
+// its key is first stored. A mode or owner set with chmod or chown
+// between creating and storing the file is kept.
+func (f *FS) createMeta(tx *bolt.Tx, path [][]byte, c *createAttrs) error {
+	if !f.meta {
+		return nil
+	}
+	m, err := getMeta(tx, path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	m.Mtime = now
+	m.Ctime = now
+	c.fillMeta(&m)
+	return putMeta(tx, path, m)
+}
+
+// fillMeta sets the mode and owner in m to those of c, where m does
+// not have them yet.
+func (c *createAttrs) fillMeta(m *metadata) {
+	if m.Mode == nil {
+		mode := c.mode & os.ModePerm
+		m.Mode = &mode
+	}
+	if m.Uid == nil {
+		uid := c.uid
+		m.Uid = &uid
+	}
+	if m.Gid == nil {
+		gid := c.gid
+		m.Gid = &gid
+	}
+}
+
+// setattrMeta applies the timestamp, mode and owner changes of a
+// Setattr request to the metadata of path.
+//
+// Without metadata storage, there is nowhere to keep mode and owner
+// changes, and they are ignored, so that tools that copy them, like
+// cp -p or tar, still work.
+func (f *FS) setattrMeta(path [][]byte, req *fuse.SetattrRequest) error {
+	if !f.meta {
+		return nil
+	}
+	fn := func(tx *bolt.Tx) error {
+		return f.applySetattr(tx, path, req)
+	}
+	return f.db.Update(fn)
+}
+
+// applySetattr is the part of setattrMeta that runs inside the
+// caller's transaction.
+func (f *FS) applySetattr(tx *bolt.Tx, path [][]byte, req *fuse.SetattrRequest) error {
+	if !f.meta {
+		return nil
+	}
+	m, err := getMeta(tx, path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	m.Ctime = now
+	switch {
+	case req.Valid.MtimeNow():
+		m.Mtime = now
+	case req.Valid.Mtime():
+		m.Mtime = req.Mtime
+	case req.Valid.Size():
+		m.Mtime = now
+	}
+	if req.Valid.Mode() {
+		mode := req.Mode & os.ModePerm
+		m.Mode = &mode
+	}
+	if req.Valid.Uid() {
+		uid := req.Uid
+		m.Uid = &uid
+	}
+	if req.Valid.Gid() {
+		gid := req.Gid
+		m.Gid = &gid
+	}
+	return putMeta(tx, path, m)
+}
+
+// dropMeta removes the metadata of path, which has been deleted.
+func (f *FS) dropMeta(tx *bolt.Tx, path [][]byte) error {
+	if !f.meta {
+		return nil
+	}
+	return deleteMeta(tx, path)
+}
+
+// renameMeta carries the metadata of oldPath over to newPath, after a
+// rename.
+func (f *FS) renameMeta(tx *bolt.Tx, oldPath, newPath [][]byte) error {
+	if !f.meta {
+		return nil
+	}
+	return moveMeta(tx, oldPath, newPath)
+}
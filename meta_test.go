@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+func TestMetaKeyPrefix(t *testing.T) {
+	parent := metaKey([][]byte{[]byte("ab")})
+	child := metaKey([][]byte{[]byte("ab"), []byte("c")})
+	sibling := metaKey([][]byte{[]byte("abc")})
+	if !bytes.HasPrefix(child, parent) {
+		t.Errorf("child key %q does not have parent prefix %q", child, parent)
+	}
+	if bytes.HasPrefix(sibling, parent) {
+		t.Errorf("sibling key %q has parent prefix %q", sibling, parent)
+	}
+}
+
+func TestMoveMeta(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		stamp := time.Date(2015, 4, 25, 18, 0, 0, 0, time.UTC)
+		oldPath := [][]byte{[]byte("bukkit")}
+		oldChild := [][]byte{[]byte("bukkit"), []byte("greeting")}
+		newPath := [][]byte{[]byte("other"), []byte("moved")}
+		newChild := [][]byte{[]byte("other"), []byte("moved"), []byte("greeting")}
+		prep := func(tx *bolt.Tx) error {
+			if err := putMeta(tx, oldPath, metadata{Mtime: stamp}); err != nil {
+				return err
+			}
+			if err := putMeta(tx, oldChild, metadata{Mtime: stamp}); err != nil {
+				return err
+			}
+			return moveMeta(tx, oldPath, newPath)
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		check := func(tx *bolt.Tx) error {
+			for _, path := range [][][]byte{oldPath, oldChild} {
+				m, err := getMeta(tx, path)
+				if err != nil {
+					return err
+				}
+				if !m.Mtime.IsZero() {
+					t.Errorf("metadata still at %q", path)
+				}
+			}
+			for _, path := range [][][]byte{newPath, newChild} {
+				m, err := getMeta(tx, path)
+				if err != nil {
+					return err
+				}
+				if !m.Mtime.Equal(stamp) {
+					t.Errorf("wrong mtime at %q: %v != %v", path, m.Mtime, stamp)
+				}
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCreateMeta(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("bukkit"))
+			return err
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		filesys := &FS{db: db, meta: true}
+		d := filesys.dirNode([][]byte{[]byte("bukkit")})
+		req := &fuse.CreateRequest{Name: "greeting", Mode: 0640}
+		req.Uid = 42
+		req.Gid = 43
+		n, h, err := d.Create(ctx, req, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := [][]byte{[]byte("bukkit"), []byte("greeting")}
+		stored := func() metadata {
+			var m metadata
+			fn := func(tx *bolt.Tx) error {
+				var err error
+				m, err = getMeta(tx, path)
+				return err
+			}
+			if err := db.View(fn); err != nil {
+				t.Fatal(err)
+			}
+			return m
+		}
+		if m := stored(); m.Mode != nil {
+			t.Errorf("metadata stored before the key")
+		}
+		var a fuse.Attr
+		if err := n.Attr(ctx, &a); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := a.Mode&os.ModePerm, os.FileMode(0640); g != e {
+			t.Errorf("wrong mode before flush: %v != %v", g, e)
+		}
+
+		if err := h.(*writeHandle).Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		m := stored()
+		if m.Mode == nil || *m.Mode != 0640 {
+			t.Errorf("wrong stored mode: %v", m.Mode)
+		}
+		if m.Uid == nil || *m.Uid != 42 || m.Gid == nil || *m.Gid != 43 {
+			t.Errorf("wrong stored owner: %v %v", m.Uid, m.Gid)
+		}
+	})
+}
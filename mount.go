@@ -1,26 +1,201 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/boltdb/bolt"
 )
 
-func mount(dbpath, mountpoint string) error {
-	db, err := bolt.Open(dbpath, 0600, nil)
+// mountOptions control how mount opens the database and serves the
+// file system.
+type mountOptions struct {
+	readOnly       bool
+	recursiveRmdir bool
+	meta           bool
+	uid            uint
+	gid            uint
+	umask          uint
+	// Bolt durability and performance knobs
+	noSync     bool
+	noGrowSync bool
+	mmapFlags  int
+	// group commit of flushes
+	batch      bool
+	batchDelay time.Duration
+	batchSize  int
+	// read snapshots
+	snapshotMax int
+	pinMax      time.Duration
+	onConflict  conflictPolicy
+	// caching of bucket statistics for directory sizes and statfs
+	statsTTL time.Duration
+	// log diagnostic counters at shutdown
+	verbose bool
+	// slash-separated path of encoded bucket names to use as the
+	// file system root
+	root       string
+	createRoot bool
+	// name of the KeyCodec for file names
+	encoding string
+}
+
+// parseBucketPath decodes a slash-separated path of encoded bucket
+// names, as seen inside the mount, into raw bucket names. Every name
+// is decoded the way its parent bucket shows its entries, so key
+// format hints apply as they do inside the mount.
+func (f *FS) parseBucketPath(tx *bolt.Tx, p string) ([][]byte, error) {
+	var buckets [][]byte
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "" {
+			// tolerate leading, trailing and doubled slashes
+			continue
+		}
+		codec, err := f.codecAt(tx, buckets)
+		if err != nil {
+			return nil, err
+		}
+		name, err := codec.Decode(seg)
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, name)
+	}
+	return buckets, nil
+}
+
+// checkRoot verifies that the bucket path exists, creating it first
+// if create is set.
+func checkRoot(db *bolt.DB, buckets [][]byte, create bool) error {
+	if len(buckets) == 0 {
+		return nil
+	}
+	if bytes.Equal(buckets[0], metaBucket) {
+		return errors.New("bucket is reserved")
+	}
+	if create {
+		return db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(buckets[0])
+			if err != nil {
+				return err
+			}
+			for _, name := range buckets[1:] {
+				b, err = b.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(buckets[0])
+		for _, name := range buckets[1:] {
+			if b == nil {
+				break
+			}
+			b = b.Bucket(name)
+		}
+		if b == nil {
+			return errors.New("bucket does not exist")
+		}
+		return nil
+	})
+}
+
+func mount(dbpath, mountpoint string, opts *mountOptions) error {
+	codec, err := lookupCodec(opts.encoding)
 	if err != nil {
 		return err
 	}
+	if opts.createRoot && opts.readOnly {
+		return errors.New("cannot create root bucket in read-only mode")
+	}
 
-	c, err := fuse.Mount(mountpoint)
+	boltOpts := bolt.Options{
+		NoGrowSync: opts.noGrowSync,
+		MmapFlags:  opts.mmapFlags,
+	}
+	var fuseOpts []fuse.MountOption
+	if opts.readOnly {
+		// shared lock, so other readers can keep the database open
+		boltOpts.ReadOnly = true
+		fuseOpts = append(fuseOpts, fuse.ReadOnly())
+	}
+	if opts.meta {
+		// let the kernel enforce the stored modes
+		fuseOpts = append(fuseOpts, fuse.DefaultPermissions())
+	}
+
+	db, err := bolt.Open(dbpath, 0600, &boltOpts)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
+	// closing twice is harmless; this covers the error paths
+	defer db.Close()
+	// with NoSync, only fsync(2) from a client syncs the file
+	db.NoSync = opts.noSync
 
 	filesys := &FS{
-		db: db,
+		db:             db,
+		readOnly:       opts.readOnly,
+		recursiveRmdir: opts.recursiveRmdir,
+		meta:           opts.meta,
+		uid:            uint32(opts.uid),
+		gid:            uint32(opts.gid),
+		umask:          os.FileMode(opts.umask) & os.ModePerm,
+		snapshotMax:    opts.snapshotMax,
+		pinMax:         opts.pinMax,
+		onConflict:     opts.onConflict,
+		statsTTL:       opts.statsTTL,
+		codec:          codec,
+	}
+	// the names in the root path may depend on key format hints
+	// stored in the database
+	parse := func(tx *bolt.Tx) error {
+		var err error
+		filesys.root, err = filesys.parseBucketPath(tx, opts.root)
+		return err
 	}
+	if err := db.View(parse); err != nil {
+		return fmt.Errorf("invalid root path %q: %v", opts.root, err)
+	}
+	if err := checkRoot(db, filesys.root, opts.createRoot); err != nil {
+		return fmt.Errorf("root %q: %v", opts.root, err)
+	}
+
+	c, err := fuse.Mount(mountpoint, fuseOpts...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if opts.batch {
+		filesys.batch = &groupCommit{
+			db:       db,
+			maxSize:  opts.batchSize,
+			maxDelay: opts.batchDelay,
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	done := make(chan struct{})
+	defer close(done)
+	go unmountOnSignal(mountpoint, sigs, done)
+
+	// Serve returns once the file system is unmounted, after all
+	// in-flight requests have completed.
 	if err := fs.Serve(c, filesys); err != nil {
 		return err
 	}
@@ -31,5 +206,34 @@ func mount(dbpath, mountpoint string) error {
 		return err
 	}
 
-	return nil
+	// handles still open at unmount time never see a Flush
+	if err := filesys.flushAll(); err != nil {
+		return err
+	}
+	// with NoSync, the last commits may not be on disk yet
+	if err := filesys.sync(); err != nil {
+		return err
+	}
+	if opts.verbose {
+		log.Printf("stats: %+v", filesys.Stats())
+	}
+	return db.Close()
+}
+
+// unmountOnSignal unmounts mountpoint whenever a signal arrives on
+// sigs, which makes fs.Serve return and lets mount shut down
+// cleanly. If unmounting fails, for example because the file system
+// is busy, the error is logged and the next signal tries again.
+func unmountOnSignal(mountpoint string, sigs <-chan os.Signal, done <-chan struct{}) {
+	for {
+		select {
+		case sig := <-sigs:
+			log.Printf("received %v, unmounting", sig)
+			if err := fuse.Unmount(mountpoint); err != nil {
+				log.Printf("cannot unmount: %v", err)
+			}
+		case <-done:
+			return
+		}
+	}
 }
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"bazil.org/fuse/fs/fstestutil"
 	"github.com/boltdb/bolt"
@@ -29,8 +33,13 @@ func withDB(t testing.TB, fn func(*bolt.DB)) {
 
 func withMount(t testing.TB, db *bolt.DB, fn func(mntpath string)) {
 	filesys := &FS{
-		db: db,
+		db:    db,
+		umask: 022,
 	}
+	withMountFS(t, filesys, fn)
+}
+
+func withMountFS(t testing.TB, filesys *FS, fn func(mntpath string)) {
 	mnt, err := fstestutil.MountedT(t, filesys, nil)
 	if err != nil {
 		t.Fatal(err)
@@ -432,7 +441,7 @@ func TestBinary(t *testing.T) {
 			if g, e := len(fis), 1; g != e {
 				t.Fatalf("wrong readdir results: got %v", fis)
 			}
-			checkFI(t, fis[0], fileInfo{name: "evil:@006c6f6c2f:mwahaha", size: 0, mode: 0755 | os.ModeDir})
+			checkFI(t, fis[0], fileInfo{name: "evil:@006c6f6c2f:mwahaha", size: 1, mode: 0755 | os.ModeDir})
 
 			fis, err = ioutil.ReadDir(filepath.Join(mntpath, "evil:@006c6f6c2f:mwahaha"))
 			if err != nil {
@@ -638,3 +647,1135 @@ func TestTruncate(t *testing.T) {
 		}
 	})
 }
+
+func TestRename(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		withMount(t, db, func(mntpath string) {
+			if err := os.Rename(
+				filepath.Join(mntpath, "bukkit", "greeting"),
+				filepath.Join(mntpath, "bukkit", "salutation"),
+			); err != nil {
+				t.Fatal(err)
+			}
+		})
+		check := func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("bukkit"))
+			if b == nil {
+				t.Fatalf("bukkit disappeared")
+			}
+			if v := b.Get([]byte("greeting")); v != nil {
+				t.Errorf("greeting is still there: %q", v)
+			}
+			v := b.Get([]byte("salutation"))
+			if g, e := string(v), "hello"; g != e {
+				t.Fatalf("wrong renamed content: %q != %q", g, e)
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRenameAcrossBuckets(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte("other")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		withMount(t, db, func(mntpath string) {
+			if err := os.Rename(
+				filepath.Join(mntpath, "bukkit", "greeting"),
+				filepath.Join(mntpath, "other", "greeting"),
+			); err != nil {
+				t.Fatal(err)
+			}
+		})
+		check := func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("bukkit"))
+			if b == nil {
+				t.Fatalf("bukkit disappeared")
+			}
+			if v := b.Get([]byte("greeting")); v != nil {
+				t.Errorf("greeting is still there: %q", v)
+			}
+			b = tx.Bucket([]byte("other"))
+			if b == nil {
+				t.Fatalf("other bukkit disappeared")
+			}
+			v := b.Get([]byte("greeting"))
+			if g, e := string(v), "hello"; g != e {
+				t.Fatalf("wrong renamed content: %q != %q", g, e)
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRenameReplace(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting.tmp"), []byte("hello")); err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("old")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		withMount(t, db, func(mntpath string) {
+			if err := os.Rename(
+				filepath.Join(mntpath, "bukkit", "greeting.tmp"),
+				filepath.Join(mntpath, "bukkit", "greeting"),
+			); err != nil {
+				t.Fatal(err)
+			}
+		})
+		check := func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("bukkit"))
+			if b == nil {
+				t.Fatalf("bukkit disappeared")
+			}
+			if v := b.Get([]byte("greeting.tmp")); v != nil {
+				t.Errorf("greeting.tmp is still there: %q", v)
+			}
+			v := b.Get([]byte("greeting"))
+			if g, e := string(v), "hello"; g != e {
+				t.Fatalf("wrong renamed content: %q != %q", g, e)
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRenameBucket(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.SetSequence(42); err != nil {
+				return err
+			}
+			sub, err := b.CreateBucket([]byte("sub"))
+			if err != nil {
+				return err
+			}
+			if err := sub.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		withMount(t, db, func(mntpath string) {
+			if err := os.Mkdir(filepath.Join(mntpath, "other"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(
+				filepath.Join(mntpath, "bukkit"),
+				filepath.Join(mntpath, "other", "moved"),
+			); err != nil {
+				t.Fatal(err)
+			}
+		})
+		check := func(tx *bolt.Tx) error {
+			if b := tx.Bucket([]byte("bukkit")); b != nil {
+				t.Errorf("bukkit is still there")
+			}
+			b := tx.Bucket([]byte("other"))
+			if b == nil {
+				t.Fatalf("other bukkit disappeared")
+			}
+			b = b.Bucket([]byte("moved"))
+			if b == nil {
+				t.Fatalf("moved bukkit not found")
+			}
+			if g, e := b.Sequence(), uint64(42); g != e {
+				t.Errorf("wrong sequence: %d != %d", g, e)
+			}
+			b = b.Bucket([]byte("sub"))
+			if b == nil {
+				t.Fatalf("sub-bukkit not copied")
+			}
+			v := b.Get([]byte("greeting"))
+			if g, e := string(v), "hello"; g != e {
+				t.Fatalf("wrong copied content: %q != %q", g, e)
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRenameBucketIntoItself(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if _, err := b.CreateBucket([]byte("sub")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		withMount(t, db, func(mntpath string) {
+			err := os.Rename(
+				filepath.Join(mntpath, "bukkit"),
+				filepath.Join(mntpath, "bukkit", "sub", "loop"),
+			)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if g, e := err.(*os.LinkError).Err, syscall.EINVAL; g != e {
+				t.Fatalf("wrong error: %v != %v", g, e)
+			}
+		})
+	})
+}
+
+func TestRmdirNotEmpty(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		withMount(t, db, func(mntpath string) {
+			err := os.Remove(filepath.Join(mntpath, "bukkit"))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if g, e := err.(*os.PathError).Err, syscall.ENOTEMPTY; g != e {
+				t.Fatalf("wrong error: %v != %v", g, e)
+			}
+		})
+		check := func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("bukkit"))
+			if b == nil {
+				t.Fatalf("bukkit disappeared")
+			}
+			v := b.Get([]byte("greeting"))
+			if g, e := string(v), "hello"; g != e {
+				t.Fatalf("wrong content: %q != %q", g, e)
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestRmdirRecursive(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{
+			db:             db,
+			recursiveRmdir: true,
+		}
+		withMountFS(t, filesys, func(mntpath string) {
+			if err := syscall.Rmdir(filepath.Join(mntpath, "bukkit")); err != nil {
+				t.Fatal(err)
+			}
+		})
+		check := func(tx *bolt.Tx) error {
+			if b := tx.Bucket([]byte("bukkit")); b != nil {
+				t.Error("bukkit is still there")
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{
+			db:       db,
+			readOnly: true,
+		}
+		withMountFS(t, filesys, func(mntpath string) {
+			data, err := ioutil.ReadFile(filepath.Join(mntpath, "bukkit", "greeting"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g, e := string(data), "hello"; g != e {
+				t.Fatalf("wrong read results: %q != %q", g, e)
+			}
+
+			checkEROFS := func(err error) {
+				if err == nil {
+					t.Error("expected an error")
+					return
+				}
+				if g, e := err.(*os.PathError).Err, syscall.EROFS; g != e {
+					t.Errorf("wrong error: %v != %v", g, e)
+				}
+			}
+			checkEROFS(os.Mkdir(filepath.Join(mntpath, "bukkit", "sub"), 0755))
+			checkEROFS(os.Remove(filepath.Join(mntpath, "bukkit", "greeting")))
+			_, err = os.Create(filepath.Join(mntpath, "bukkit", "new"))
+			checkEROFS(err)
+			_, err = os.OpenFile(filepath.Join(mntpath, "bukkit", "greeting"), os.O_WRONLY, 0)
+			checkEROFS(err)
+		})
+	})
+}
+
+func TestFlushAll(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{
+			db: db,
+		}
+		withMountFS(t, filesys, func(mntpath string) {
+			f, err := os.Create(filepath.Join(mntpath, "bukkit", "greeting"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := f.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			// simulate shutdown with the handle still open
+			if err := filesys.flushAll(); err != nil {
+				t.Fatal(err)
+			}
+			check := func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("bukkit"))
+				if b == nil {
+					t.Fatalf("bukkit disappeared")
+				}
+				v := b.Get([]byte("greeting"))
+				if g, e := string(v), "hello"; g != e {
+					t.Fatalf("wrong write content: %q != %q", g, e)
+				}
+				return nil
+			}
+			if err := db.View(check); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+}
+
+func TestParseBucketPath(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		filesys := &FS{db: db}
+		var buckets [][]byte
+		fn := func(tx *bolt.Tx) error {
+			var err error
+			buckets, err = filesys.parseBucketPath(tx, "/app/@0102:foo/users/")
+			return err
+		}
+		if err := db.View(fn); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := len(buckets), 3; g != e {
+			t.Fatalf("wrong number of buckets: %q", buckets)
+		}
+		if g, e := string(buckets[1]), "\x01\x02foo"; g != e {
+			t.Errorf("wrong decoded bucket: %q != %q", g, e)
+		}
+	})
+}
+
+func TestParseBucketPathKeyFormat(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("app"))
+			if err != nil {
+				return err
+			}
+			return putMeta(tx, [][]byte{[]byte("app")}, metadata{KeyFormat: "uint64be"})
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{db: db, meta: true}
+		var buckets [][]byte
+		fn := func(tx *bolt.Tx) error {
+			var err error
+			buckets, err = filesys.parseBucketPath(tx, "app/42")
+			return err
+		}
+		if err := db.View(fn); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := string(buckets[1]), "\x00\x00\x00\x00\x00\x00\x00\x2a"; g != e {
+			t.Errorf("name not decoded with key format: %q != %q", g, e)
+		}
+	})
+}
+
+func TestCheckRoot(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		root := [][]byte{[]byte("app"), []byte("users")}
+		if err := checkRoot(db, root, false); err == nil {
+			t.Fatal("expected error for missing root")
+		}
+		if err := checkRoot(db, root, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkRoot(db, root, false); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSubRoot(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("app"))
+			if err != nil {
+				return err
+			}
+			b, err = b.CreateBucket([]byte("users"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("alice"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{
+			db:   db,
+			root: [][]byte{[]byte("app"), []byte("users")},
+		}
+		withMountFS(t, filesys, func(mntpath string) {
+			data, err := ioutil.ReadFile(filepath.Join(mntpath, "alice"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g, e := string(data), "hello"; g != e {
+				t.Fatalf("wrong read results: %q != %q", g, e)
+			}
+		})
+	})
+}
+
+func TestMetaTimes(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		filesys := &FS{
+			db:   db,
+			meta: true,
+		}
+		withMountFS(t, filesys, func(mntpath string) {
+			if err := os.Mkdir(filepath.Join(mntpath, "bukkit"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			p := filepath.Join(mntpath, "bukkit", "greeting")
+			if err := ioutil.WriteFile(p, []byte("hello"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.ModTime().IsZero() || fi.ModTime().Unix() == 0 {
+				t.Errorf("write did not set mtime: %v", fi.ModTime())
+			}
+
+			stamp := time.Date(2015, 4, 25, 18, 0, 0, 0, time.UTC)
+			if err := os.Chtimes(p, stamp, stamp); err != nil {
+				t.Fatal(err)
+			}
+			fi, err = os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g, e := fi.ModTime(), stamp; !g.Equal(e) {
+				t.Errorf("wrong mtime: %v != %v", g, e)
+			}
+
+			fis, err := ioutil.ReadDir(mntpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g, e := len(fis), 1; g != e {
+				t.Fatalf("metadata bucket not hidden: got %v", fis)
+			}
+		})
+	})
+}
+
+func TestChmod(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{
+			db:    db,
+			meta:  true,
+			umask: 022,
+		}
+		withMountFS(t, filesys, func(mntpath string) {
+			p := filepath.Join(mntpath, "bukkit", "greeting")
+			if err := os.Chmod(p, 0400); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFI(t, fi, fileInfo{name: "greeting", size: 5, mode: 0400})
+
+			if err := os.Chmod(filepath.Join(mntpath, "bukkit"), 0700); err != nil {
+				t.Fatal(err)
+			}
+			fi, err = os.Stat(filepath.Join(mntpath, "bukkit"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFI(t, fi, fileInfo{name: "bukkit", size: 1, mode: 0700 | os.ModeDir})
+		})
+	})
+}
+
+func TestChmodWithoutMeta(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		withMount(t, db, func(mntpath string) {
+			// accepted, but there is nowhere to keep it
+			p := filepath.Join(mntpath, "bukkit", "greeting")
+			if err := os.Chmod(p, 0400); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkFI(t, fi, fileInfo{name: "greeting", size: 5, mode: 0644})
+
+			if err := os.Chmod(filepath.Join(mntpath, "bukkit"), 0700); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+}
+
+func TestChown(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("chown requires root")
+	}
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{
+			db:   db,
+			meta: true,
+		}
+		withMountFS(t, filesys, func(mntpath string) {
+			p := filepath.Join(mntpath, "bukkit", "greeting")
+			if err := os.Chown(p, 1234, 5678); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			st := fi.Sys().(*syscall.Stat_t)
+			if g, e := st.Uid, uint32(1234); g != e {
+				t.Errorf("wrong uid: %v != %v", g, e)
+			}
+			if g, e := st.Gid, uint32(5678); g != e {
+				t.Errorf("wrong gid: %v != %v", g, e)
+			}
+		})
+	})
+}
+
+func testTruncateWithoutHandle(t *testing.T, size int64, want string) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		withMount(t, db, func(mntpath string) {
+			if err := os.Truncate(filepath.Join(mntpath, "bukkit", "greeting"), size); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(filepath.Join(mntpath, "bukkit", "greeting"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g, e := fi.Size(), size; g != e {
+				t.Errorf("wrong size after truncate: %d != %d", g, e)
+			}
+		})
+		check := func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("bukkit"))
+			if b == nil {
+				t.Fatalf("bukkit disappeared")
+			}
+			v := b.Get([]byte("greeting"))
+			if g, e := string(v), want; g != e {
+				t.Fatalf("wrong content: %q != %q", g, e)
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTruncateShrinkWithoutHandle(t *testing.T) {
+	testTruncateWithoutHandle(t, 2, "he")
+}
+
+func TestTruncateGrowWithoutHandle(t *testing.T) {
+	testTruncateWithoutHandle(t, 7, "hello\x00\x00")
+}
+
+func TestFsync(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		db.NoSync = true
+		withMount(t, db, func(mntpath string) {
+			f, err := os.Create(filepath.Join(mntpath, "bukkit", "greeting"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if _, err := f.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			check := func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("bukkit"))
+				if b == nil {
+					t.Fatalf("bukkit disappeared")
+				}
+				v := b.Get([]byte("greeting"))
+				if g, e := string(v), "hello"; g != e {
+					t.Fatalf("fsync did not commit: %q != %q", g, e)
+				}
+				return nil
+			}
+			if err := db.View(check); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+}
+
+func TestFlushSkipsClean(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{
+			db: db,
+		}
+		withMountFS(t, filesys, func(mntpath string) {
+			f, err := os.OpenFile(filepath.Join(mntpath, "bukkit", "greeting"), os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if g := filesys.Stats().FlushesSkipped; g == 0 {
+				t.Errorf("clean flush was not skipped")
+			}
+		})
+	})
+}
+
+func TestBatchFlush(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{
+			db: db,
+			batch: &groupCommit{
+				db: db,
+				// long enough for the writers to show up on a
+				// slow machine
+				maxDelay: 200 * time.Millisecond,
+			},
+		}
+		const n = 10
+		withMountFS(t, filesys, func(mntpath string) {
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				go func(i int) {
+					errs <- ioutil.WriteFile(
+						filepath.Join(mntpath, "bukkit", fmt.Sprintf("file%d", i)),
+						[]byte("hello"),
+						0600,
+					)
+				}(i)
+			}
+			for i := 0; i < n; i++ {
+				if err := <-errs; err != nil {
+					t.Error(err)
+				}
+			}
+		})
+		s := filesys.Stats()
+		if g, e := s.Flushes, uint64(n); g != e {
+			t.Errorf("wrong number of flushes: %d != %d", g, e)
+		}
+		if s.Commits >= s.Flushes {
+			t.Errorf("flushes did not share commits: %d commits for %d flushes", s.Commits, s.Flushes)
+		}
+		check := func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("bukkit"))
+			if b == nil {
+				t.Fatalf("bukkit disappeared")
+			}
+			for i := 0; i < n; i++ {
+				v := b.Get([]byte(fmt.Sprintf("file%d", i)))
+				if g, e := string(v), "hello"; g != e {
+					t.Errorf("wrong content in file%d: %q != %q", i, g, e)
+				}
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func testWriteConflict(t *testing.T, policy conflictPolicy, check func(t *testing.T, closeErr error, b *bolt.Bucket)) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{
+			db:         db,
+			onConflict: policy,
+		}
+		var closeErr error
+		withMountFS(t, filesys, func(mntpath string) {
+			f, err := os.OpenFile(filepath.Join(mntpath, "bukkit", "greeting"), os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// change the value behind the open handle's back
+			change := func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("bukkit")).Put([]byte("greeting"), []byte("external"))
+			}
+			if err := db.Update(change); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt([]byte("J"), 0); err != nil {
+				t.Fatal(err)
+			}
+			closeErr = f.Close()
+		})
+		err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("bukkit"))
+			if b == nil {
+				t.Fatalf("bukkit disappeared")
+			}
+			check(t, closeErr, b)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestWriteConflict(t *testing.T) {
+	testWriteConflict(t, conflictStale, func(t *testing.T, closeErr error, b *bolt.Bucket) {
+		if closeErr == nil {
+			t.Fatal("expected an error from close")
+		}
+		if g, e := closeErr.(*os.PathError).Err, syscall.ESTALE; g != e {
+			t.Errorf("wrong error: %v != %v", g, e)
+		}
+		v := b.Get([]byte("greeting"))
+		if g, e := string(v), "external"; g != e {
+			t.Errorf("external change lost: %q != %q", g, e)
+		}
+	})
+}
+
+func TestWriteConflictCopy(t *testing.T) {
+	testWriteConflict(t, conflictCopy, func(t *testing.T, closeErr error, b *bolt.Bucket) {
+		if closeErr != nil {
+			t.Fatal(closeErr)
+		}
+		v := b.Get([]byte("greeting"))
+		if g, e := string(v), "external"; g != e {
+			t.Errorf("external change lost: %q != %q", g, e)
+		}
+		c := b.Cursor()
+		prefix := []byte("greeting.conflict-")
+		k, v := c.Seek(prefix)
+		if k == nil || !bytes.HasPrefix(k, prefix) {
+			t.Fatalf("no conflict copy found")
+		}
+		if g, e := string(v), "Jello"; g != e {
+			t.Errorf("wrong conflict copy: %q != %q", g, e)
+		}
+	})
+}
+
+// withTwoWriters opens greeting, holding "hello", twice for writing.
+func withTwoWriters(t *testing.T, policy conflictPolicy, fn func(db *bolt.DB, f1, f2 *os.File)) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		filesys := &FS{
+			db:         db,
+			onConflict: policy,
+		}
+		withMountFS(t, filesys, func(mntpath string) {
+			p := filepath.Join(mntpath, "bukkit", "greeting")
+			f1, err := os.OpenFile(p, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f1.Close()
+			f2, err := os.OpenFile(p, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f2.Close()
+			fn(db, f1, f2)
+		})
+	})
+}
+
+func TestFsyncOnlyOwnHandle(t *testing.T) {
+	withTwoWriters(t, conflictCopy, func(db *bolt.DB, f1, f2 *os.File) {
+		if _, err := f1.WriteAt([]byte("J"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f2.WriteAt([]byte("Y"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := f1.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		check := func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("bukkit"))
+			if g, e := string(b.Get([]byte("greeting"))), "Jello"; g != e {
+				t.Errorf("fsync did not commit own buffer: %q != %q", g, e)
+			}
+			prefix := []byte("greeting.conflict-")
+			if k, _ := b.Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+				t.Errorf("other writer's buffer saved as %q", k)
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestTruncateOnlyOwnHandle(t *testing.T) {
+	withTwoWriters(t, conflictStale, func(db *bolt.DB, f1, f2 *os.File) {
+		if _, err := f1.WriteAt([]byte("J"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f2.WriteAt([]byte("Y"), 4); err != nil {
+			t.Fatal(err)
+		}
+		if err := f1.Truncate(2); err != nil {
+			t.Fatal(err)
+		}
+		if err := f2.Close(); err != nil {
+			t.Fatalf("other writer got an error: %v", err)
+		}
+		check := func(tx *bolt.Tx) error {
+			v := tx.Bucket([]byte("bukkit")).Get([]byte("greeting"))
+			if g, e := string(v), "hellY"; g != e {
+				t.Errorf("other writer's data lost: %q != %q", g, e)
+			}
+			return nil
+		}
+		if err := db.View(check); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestInodeStable(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("greeting"), []byte("hello"))
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+		withMount(t, db, func(mntpath string) {
+			p := filepath.Join(mntpath, "bukkit", "greeting")
+			fi, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ino := fi.Sys().(*syscall.Stat_t).Ino
+			if g, e := ino, inode([][]byte{[]byte("bukkit"), []byte("greeting")}); g != e {
+				t.Errorf("wrong inode: %d != %d", g, e)
+			}
+
+			if err := os.Remove(p); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, []byte("again"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			fi, err = os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g, e := fi.Sys().(*syscall.Stat_t).Ino, ino; g != e {
+				t.Errorf("inode changed on recreate: %d != %d", g, e)
+			}
+		})
+	})
+}
+
+func TestBackupMount(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "bolt-mount-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	// room to grow without remapping, which waits for the open
+	// backup
+	db, err := bolt.Open(filepath.Join(tmp, "db"), 0600, &bolt.Options{InitialMmapSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	put := func(key string) {
+		fn := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(key), make([]byte, 10000))
+		}
+		if err := db.Update(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("one")
+	withMount(t, db, func(mntpath string) {
+		p := filepath.Join(mntpath, ctlName, backupName)
+		if _, err := os.Stat(p); err != nil {
+			t.Fatal(err)
+		}
+		// after the attributes were last seen, but before the open
+		put("two")
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		// after the open, so not in the copy
+		put("three")
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g, e := int64(len(data)), fi.Size(); g != e {
+			t.Errorf("backup size differs from fstat: %d != %d", g, e)
+		}
+	})
+}
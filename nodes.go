@@ -0,0 +1,177 @@
+package main
+
+import (
+	"hash/fnv"
+	"strings"
+
+	"bazil.org/fuse/fs"
+)
+
+// The FS keeps a cache of the nodes the kernel holds references to,
+// keyed by the metaKey of their raw path, so that looking up the same
+// path twice returns the same Dir or File. This is what lets open
+// handles on a file share state, and renames update nodes in place.
+//
+// Nodes are dropped from the cache when the kernel forgets them, and
+// when the key or bucket they stand for is deleted. A key that is
+// deleted and then recreated thus gets a new node, and the fuse
+// library gives every new node a new node ID or generation number,
+// so the kernel can tell the two apart.
+
+// inode returns the inode number for the raw path. It is derived from
+// the path alone, so it is stable across lookups and remounts.
+func inode(path [][]byte) uint64 {
+	h := fnv.New64a()
+	h.Write(metaKey(path))
+	ino := h.Sum64()
+	if ino < 2 {
+		// 0 means unset and 1 is used by the fuse library for the root
+		ino += 2
+	}
+	return ino
+}
+
+// cacheNode records n as the node for key, replacing any other.
+// Caller must hold f.mu.
+func (f *FS) cacheNode(key string, n fs.Node) {
+	if f.nodes == nil {
+		f.nodes = make(map[string]fs.Node)
+	}
+	f.nodes[key] = n
+}
+
+// dirNode returns the Dir for the bucket at path.
+func (f *FS) dirNode(path [][]byte) *Dir {
+	key := string(metaKey(path))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d, ok := f.nodes[key].(*Dir); ok {
+		return d
+	}
+	d := &Dir{
+		fs:      f,
+		buckets: path,
+	}
+	f.cacheNode(key, d)
+	return d
+}
+
+// fileNode returns the File for the key name inside dir.
+func (f *FS) fileNode(dir *Dir, name []byte) *File {
+	key := string(metaKey(dir.childPath(name)))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n, ok := f.nodes[key].(*File); ok {
+		return n
+	}
+	n := &File{
+		dir:  dir,
+		name: name,
+	}
+	f.cacheNode(key, n)
+	return n
+}
+
+// cachedFile returns the cached File for the key at path, or nil if
+// there is none.
+func (f *FS) cachedFile(path [][]byte) *File {
+	key := string(metaKey(path))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, _ := f.nodes[key].(*File)
+	return n
+}
+
+// newFileNode returns a new File for the key name inside dir, for a
+// key that is being created, replacing any node cached for it.
+func (f *FS) newFileNode(dir *Dir, name []byte) *File {
+	key := string(metaKey(dir.childPath(name)))
+	n := &File{
+		dir:  dir,
+		name: name,
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cacheNode(key, n)
+	return n
+}
+
+// evictNodes drops the nodes for path and everything inside it from
+// the cache, after they have been deleted. Caller must hold f.mu.
+func (f *FS) evictNodes(path [][]byte) {
+	prefix := string(metaKey(path))
+	for key := range f.nodes {
+		if strings.HasPrefix(key, prefix) {
+			delete(f.nodes, key)
+		}
+	}
+}
+
+// removed is called after path has been deleted.
+func (f *FS) removed(path [][]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.evictNodes(path)
+}
+
+// forget drops n from the cache, if it is still the node for path.
+func (f *FS) forget(path [][]byte, n fs.Node) {
+	key := string(metaKey(path))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.nodes[key] == n {
+		delete(f.nodes, key)
+	}
+}
+
+// renamed is called after the key or bucket at oldPath has been
+// moved to newPath, whose parent is newDir. The cached nodes for it,
+// and for everything inside it, are updated to their new paths, so
+// the references the kernel holds to them stay valid.
+func (f *FS) renamed(oldPath, newPath [][]byte, newDir *Dir) {
+	oldPrefix := string(metaKey(oldPath))
+	newPrefix := string(metaKey(newPath))
+
+	type move struct {
+		key string
+		n   fs.Node
+	}
+	var moves []move
+	f.mu.Lock()
+	for key, n := range f.nodes {
+		if strings.HasPrefix(key, oldPrefix) {
+			moves = append(moves, move{key, n})
+		}
+	}
+	for _, m := range moves {
+		delete(f.nodes, m.key)
+	}
+	// whatever was at the destination has been replaced
+	f.evictNodes(newPath)
+	for _, m := range moves {
+		f.cacheNode(newPrefix+m.key[len(oldPrefix):], m.n)
+	}
+	f.mu.Unlock()
+
+	// Node locks are taken without holding f.mu, because code
+	// holding a File lock may call into the FS.
+	for _, m := range moves {
+		switch n := m.n.(type) {
+		case *Dir:
+			p := n.path()
+			np := make([][]byte, 0, len(newPath)+len(p)-len(oldPath))
+			np = append(np, newPath...)
+			np = append(np, p[len(oldPath):]...)
+			n.setPath(np)
+		case *File:
+			if m.key != oldPrefix {
+				// inside a renamed bucket; follows its Dir
+				continue
+			}
+			n.mu.Lock()
+			n.dir = newDir
+			n.name = newPath[len(newPath)-1]
+			n.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+func TestNodeCache(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			sub, err := b.CreateBucket([]byte("sub"))
+			if err != nil {
+				return err
+			}
+			return sub.Put([]byte("greeting"), []byte("hello"))
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		filesys := &FS{db: db}
+		root, err := filesys.Root()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bukkit, err := root.(*Dir).Lookup(ctx, "bukkit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := bukkit.(*Dir).Lookup(ctx, "sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f1, err := sub.(*Dir).Lookup(ctx, "greeting")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f2, err := sub.(*Dir).Lookup(ctx, "greeting")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f1 != f2 {
+			t.Errorf("lookup returned different nodes: %p != %p", f1, f2)
+		}
+
+		var a fuse.Attr
+		if err := f1.Attr(ctx, &a); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := a.Inode, inode([][]byte{[]byte("bukkit"), []byte("sub"), []byte("greeting")}); g != e {
+			t.Errorf("wrong inode: %d != %d", g, e)
+		}
+
+		req := &fuse.RenameRequest{OldName: "sub", NewName: "moved"}
+		if err := bukkit.(*Dir).Rename(ctx, req, bukkit); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := string(sub.(*Dir).path()[1]), "moved"; g != e {
+			t.Errorf("renamed dir has wrong path: %q != %q", g, e)
+		}
+		// the node still held by the kernel keeps working
+		if err := f1.Attr(ctx, &a); err != nil {
+			t.Fatalf("attr after rename: %v", err)
+		}
+		if g, e := a.Size, uint64(len("hello")); g != e {
+			t.Errorf("wrong size after rename: %d != %d", g, e)
+		}
+		f3, err := bukkit.(*Dir).Lookup(ctx, "moved")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f3 != sub {
+			t.Errorf("lookup after rename returned a new node")
+		}
+
+		rm := &fuse.RemoveRequest{Name: "greeting"}
+		if err := sub.(*Dir).Remove(ctx, rm); err != nil {
+			t.Fatal(err)
+		}
+		filesys.mu.Lock()
+		_, cached := filesys.nodes[string(metaKey([][]byte{[]byte("bukkit"), []byte("moved"), []byte("greeting")}))]
+		filesys.mu.Unlock()
+		if cached {
+			t.Errorf("removed file still cached")
+		}
+	})
+}
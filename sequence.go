@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bazil.org/fuse/fuseutil"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+// Every bucket directory has two virtual files for the sequence
+// number of the bucket: reading seqName shows it, and writing a
+// number into it sets it; every open of nextName increments it and
+// shows the new value. As for ctlName, the leading dot keeps the
+// names from colliding with keys.
+const (
+	seqName  = ".sequence"
+	nextName = ".next"
+)
+
+// formatSeq renders a sequence number as the contents of a file.
+func formatSeq(n uint64) []byte {
+	return []byte(strconv.FormatUint(n, 10) + "\n")
+}
+
+// seqFile is the virtual file called seqName in dir.
+type seqFile struct {
+	dir *Dir
+}
+
+var _ = fs.Node(&seqFile{})
+
+func (s *seqFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = virtualInode(string(metaKey(s.dir.path())), seqName)
+	perm := os.FileMode(0666)
+	if s.dir.fs.readOnly {
+		perm = 0444
+	}
+	s.dir.fs.defaultAttr(a, perm)
+	return nil
+}
+
+var _ = fs.NodeSetattrer(&seqFile{})
+
+// Setattr accepts and ignores everything, as a write always replaces
+// the whole number anyway. This lets O_TRUNC and touch(1) work.
+func (s *seqFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if s.dir.fs.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return nil
+}
+
+var _ = fs.NodeOpener(&seqFile{})
+
+func (s *seqFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	// the contents change without the kernel knowing
+	resp.Flags |= fuse.OpenDirectIO
+	if !req.Flags.IsReadOnly() {
+		if s.dir.fs.readOnly {
+			return nil, fuse.Errno(syscall.EROFS)
+		}
+		// written data replaces the sequence, so start empty
+		return &seqHandle{dir: s.dir}, nil
+	}
+
+	var n uint64
+	fn := func(tx *bolt.Tx) error {
+		b := bucketAt(tx, s.dir.path())
+		if b == nil {
+			return errBucketGone
+		}
+		n = b.Sequence()
+		return nil
+	}
+	if err := s.dir.fs.db.View(fn); err != nil {
+		return nil, translateError(err)
+	}
+	return &seqHandle{dir: s.dir, data: formatSeq(n)}, nil
+}
+
+// seqHandle is an open seqFile. A handle opened for writing collects
+// the written data, and sets the sequence to the number in it on
+// flush.
+type seqHandle struct {
+	dir *Dir
+
+	mu    sync.Mutex
+	data  []byte
+	dirty bool
+}
+
+var _ = fs.HandleReader(&seqHandle{})
+
+func (h *seqHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fuseutil.HandleRead(req, resp, h.data)
+	return nil
+}
+
+var _ = fs.HandleWriter(&seqHandle{})
+
+func (h *seqHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// a sequence number is never this long, anyway
+	const maxLen = 64
+	end := req.Offset + int64(len(req.Data))
+	if end > maxLen {
+		return fuse.Errno(syscall.EFBIG)
+	}
+	if int(end) > len(h.data) {
+		h.data = resize(h.data, int(end))
+	}
+	resp.Size = copy(h.data[req.Offset:], req.Data)
+	h.dirty = true
+	return nil
+}
+
+var _ = fs.HandleFlusher(&seqHandle{})
+
+func (h *seqHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.dirty {
+		return nil
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(h.data)), 10, 64)
+	if err != nil {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	fn := func(tx *bolt.Tx) error {
+		b := bucketAt(tx, h.dir.path())
+		if b == nil {
+			return errBucketGone
+		}
+		return b.SetSequence(n)
+	}
+	if err := h.dir.fs.update(fn); err != nil {
+		return translateError(err)
+	}
+	h.dirty = false
+	return nil
+}
+
+// nextFile is the virtual file called nextName in dir.
+type nextFile struct {
+	dir *Dir
+}
+
+var _ = fs.Node(&nextFile{})
+
+func (n *nextFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = virtualInode(string(metaKey(n.dir.path())), nextName)
+	n.dir.fs.defaultAttr(a, 0444)
+	return nil
+}
+
+var _ = fs.NodeOpener(&nextFile{})
+
+// Open takes the next number from the sequence. All reads through
+// the handle return that same number.
+func (n *nextFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	if n.dir.fs.readOnly {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	var seq uint64
+	fn := func(tx *bolt.Tx) error {
+		b := bucketAt(tx, n.dir.path())
+		if b == nil {
+			return errBucketGone
+		}
+		var err error
+		seq, err = b.NextSequence()
+		return err
+	}
+	if err := n.dir.fs.update(fn); err != nil {
+		return nil, translateError(err)
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return &seqHandle{dir: n.dir, data: formatSeq(seq)}, nil
+}
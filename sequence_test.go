@@ -0,0 +1,81 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+func TestSequenceFiles(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return b.SetSequence(41)
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		filesys := &FS{db: db}
+		d := filesys.dirNode([][]byte{[]byte("bukkit")})
+		lookup := func(name string) fs.NodeOpener {
+			n, err := d.Lookup(ctx, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n.(fs.NodeOpener)
+		}
+		read := func(name string) string {
+			h, err := lookup(name).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(h.(*seqHandle).data)
+		}
+
+		if g, e := read(seqName), "41\n"; g != e {
+			t.Errorf("wrong sequence: %q != %q", g, e)
+		}
+		if g, e := read(nextName), "42\n"; g != e {
+			t.Errorf("wrong next: %q != %q", g, e)
+		}
+		if g, e := read(nextName), "43\n"; g != e {
+			t.Errorf("wrong next: %q != %q", g, e)
+		}
+
+		h, err := lookup(seqName).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sh := h.(*seqHandle)
+		if err := sh.Write(ctx, &fuse.WriteRequest{Data: []byte("1000\n")}, &fuse.WriteResponse{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := sh.Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := read(seqName), "1000\n"; g != e {
+			t.Errorf("wrong sequence after write: %q != %q", g, e)
+		}
+
+		sh.data = []byte("bogus")
+		sh.dirty = true
+		if err := sh.Flush(ctx, &fuse.FlushRequest{}); err != fuse.Errno(syscall.EINVAL) {
+			t.Errorf("expected EINVAL, got %v", err)
+		}
+
+		// not in the root of the database, which is not a bucket
+		root := filesys.dirNode(nil)
+		if _, err := root.Lookup(ctx, seqName); err != fuse.ENOENT {
+			t.Errorf("expected ENOENT at root, got %v", err)
+		}
+	})
+}
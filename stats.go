@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+// Stats are counters kept per mount, for diagnostics.
+type Stats struct {
+	// Lookup requests, and open requests on files.
+	Lookups uint64
+	Opens   uint64
+	// Read and write requests on file handles.
+	Reads  uint64
+	Writes uint64
+	// Flush requests on write handles that were committed to the
+	// database.
+	Flushes uint64
+	// Flush requests on write handles that had nothing new to
+	// write, and so skipped the database commit.
+	FlushesSkipped uint64
+	// Flushes that found the value changed since the handle was
+	// opened.
+	Conflicts uint64
+	// Database commits made for flushes and sequence updates. With
+	// group commit, concurrent flushes share commits, so there are
+	// fewer of these than Flushes.
+	Commits uint64
+	// Keys left out of directory listings, because their file names
+	// would be longer than maxNameLen; counted on every listing.
+	KeysHidden uint64
+}
+
+// counters holds the live values behind Stats. All fields are
+// accessed atomically.
+type counters struct {
+	lookups        uint64
+	opens          uint64
+	reads          uint64
+	writes         uint64
+	flushes        uint64
+	flushesSkipped uint64
+	conflicts      uint64
+	commits        uint64
+	keysHidden     uint64
+}
+
+// Stats returns a snapshot of the counters of this mount.
+func (f *FS) Stats() Stats {
+	return Stats{
+		Lookups:        atomic.LoadUint64(&f.counters.lookups),
+		Opens:          atomic.LoadUint64(&f.counters.opens),
+		Reads:          atomic.LoadUint64(&f.counters.reads),
+		Writes:         atomic.LoadUint64(&f.counters.writes),
+		Flushes:        atomic.LoadUint64(&f.counters.flushes),
+		FlushesSkipped: atomic.LoadUint64(&f.counters.flushesSkipped),
+		Conflicts:      atomic.LoadUint64(&f.counters.conflicts),
+		Commits:        atomic.LoadUint64(&f.counters.commits),
+		KeysHidden:     atomic.LoadUint64(&f.counters.keysHidden),
+	}
+}
+
+// statsCacheMax is the number of cached bucket statistics above which
+// expired entries are swept out.
+const statsCacheMax = 1024
+
+type statsEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// treeStats returns the statistics of the bucket at path, including
+// everything nested in it. For the root of the database, these are
+// the sums over all its buckets, with the bucket names counted as
+// keys, like Bolt does for nested buckets.
+func treeStats(tx *bolt.Tx, path [][]byte) (bolt.BucketStats, error) {
+	if len(path) == 0 {
+		s := bolt.BucketStats{BucketN: 1}
+		fn := func(name []byte, b *bolt.Bucket) error {
+			if bytes.Equal(name, metaBucket) {
+				return nil
+			}
+			s.KeyN++
+			s.Add(b.Stats())
+			return nil
+		}
+		err := tx.ForEach(fn)
+		return s, err
+	}
+	b := bucketAt(tx, path)
+	if b == nil {
+		return bolt.BucketStats{}, errBucketGone
+	}
+	return b.Stats(), nil
+}
+
+// childCounts is the number of entries directly in a bucket. Unlike
+// bolt.BucketStats, it does not include anything nested deeper.
+type childCounts struct {
+	Keys    int
+	Buckets int
+}
+
+// countChildren returns the childCounts of the bucket at path.
+func countChildren(tx *bolt.Tx, path [][]byte) (childCounts, error) {
+	var c *bolt.Cursor
+	if len(path) == 0 {
+		c = tx.Cursor()
+	} else {
+		b := bucketAt(tx, path)
+		if b == nil {
+			return childCounts{}, errBucketGone
+		}
+		c = b.Cursor()
+	}
+	var n childCounts
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		switch {
+		case len(path) == 0 && bytes.Equal(k, metaBucket):
+			// hidden
+		case v == nil:
+			n.Buckets++
+		default:
+			n.Keys++
+		}
+	}
+	return n, nil
+}
+
+// statsKey returns the key in f.statsCache for statistics of kind
+// for the bucket at path.
+func statsKey(kind string, path [][]byte) string {
+	return kind + "\x00" + string(metaKey(path))
+}
+
+// cachedStats returns the result of fn for the bucket at path. As
+// fn may have to walk the whole bucket, results are cached for
+// f.statsTTL, separately for every kind.
+func (f *FS) cachedStats(kind string, path [][]byte, fn func(*bolt.Tx) (interface{}, error)) (interface{}, error) {
+	key := statsKey(kind, path)
+	now := time.Now()
+	if f.statsTTL > 0 {
+		f.statsMu.Lock()
+		e, ok := f.statsCache[key]
+		f.statsMu.Unlock()
+		if ok && now.Before(e.expires) {
+			return e.value, nil
+		}
+	}
+
+	var v interface{}
+	view := func(tx *bolt.Tx) error {
+		var err error
+		v, err = fn(tx)
+		return err
+	}
+	if err := f.db.View(view); err != nil {
+		return nil, err
+	}
+
+	if f.statsTTL > 0 {
+		f.statsMu.Lock()
+		defer f.statsMu.Unlock()
+		if f.statsCache == nil {
+			f.statsCache = make(map[string]statsEntry)
+		}
+		if len(f.statsCache) >= statsCacheMax {
+			for k, e := range f.statsCache {
+				if !now.Before(e.expires) {
+					delete(f.statsCache, k)
+				}
+			}
+		}
+		f.statsCache[key] = statsEntry{value: v, expires: now.Add(f.statsTTL)}
+	}
+	return v, nil
+}
+
+// statsChanged drops the cached statistics made stale by the mount
+// itself adding, removing or moving the key or bucket at path: those
+// of path and everything inside it, the child counts of its parent,
+// and the tree statistics of every bucket above it. Changes made
+// outside the mount still show after f.statsTTL.
+func (f *FS) statsChanged(path [][]byte) {
+	if len(path) == 0 {
+		return
+	}
+	parent := path[:len(path)-1]
+	under := string(metaKey(path))
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+	for key := range f.statsCache {
+		i := strings.IndexByte(key, 0)
+		if strings.HasPrefix(key[i+1:], under) {
+			delete(f.statsCache, key)
+		}
+	}
+	delete(f.statsCache, statsKey("children", parent))
+	for i := 0; i <= len(parent); i++ {
+		delete(f.statsCache, statsKey("tree", parent[:i]))
+	}
+}
+
+// bucketStats returns treeStats for path, cached.
+func (f *FS) bucketStats(path [][]byte) (bolt.BucketStats, error) {
+	fn := func(tx *bolt.Tx) (interface{}, error) {
+		return treeStats(tx, path)
+	}
+	v, err := f.cachedStats("tree", path, fn)
+	if err != nil {
+		return bolt.BucketStats{}, err
+	}
+	return v.(bolt.BucketStats), nil
+}
+
+// children returns countChildren for path, cached.
+func (f *FS) children(path [][]byte) (childCounts, error) {
+	fn := func(tx *bolt.Tx) (interface{}, error) {
+		return countChildren(tx, path)
+	}
+	v, err := f.cachedStats("children", path, fn)
+	if err != nil {
+		return childCounts{}, err
+	}
+	return v.(childCounts), nil
+}
+
+var _ = fs.FSStatfser(&FS{})
+
+// Statfs reports the pages of the database file as blocks, with the
+// pages on the freelist as free. There is no limit on the number of
+// files, so any number of them is reported free.
+func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	fi, err := os.Stat(f.db.Path())
+	if err != nil {
+		return err
+	}
+	pageSize := uint64(f.db.Info().PageSize)
+	s, err := f.bucketStats(nil)
+	if err != nil {
+		return translateError(err)
+	}
+	free := uint64(f.db.Stats().FreePageN)
+
+	resp.Bsize = uint32(pageSize)
+	resp.Frsize = uint32(pageSize)
+	resp.Blocks = uint64(fi.Size()) / pageSize
+	resp.Bfree = free
+	resp.Bavail = free
+	resp.Ffree = math.MaxUint32
+	resp.Files = uint64(s.KeyN) + resp.Ffree
+	resp.Namelen = 255
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+func TestDirAttrStats(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("greeting"), []byte("hello")); err != nil {
+				return err
+			}
+			one, err := b.CreateBucket([]byte("one"))
+			if err != nil {
+				return err
+			}
+			if _, err := b.CreateBucket([]byte("two")); err != nil {
+				return err
+			}
+			// nested deeper, not counted for bukkit
+			if err := one.Put([]byte("deep"), []byte("x")); err != nil {
+				return err
+			}
+			if _, err := one.CreateBucket([]byte("deeper")); err != nil {
+				return err
+			}
+			return nil
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		filesys := &FS{db: db, statsTTL: time.Hour}
+		d := filesys.dirNode([][]byte{[]byte("bukkit")})
+		var a fuse.Attr
+		if err := d.Attr(ctx, &a); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := a.Size, uint64(3); g != e {
+			t.Errorf("wrong size: %d != %d", g, e)
+		}
+		if g, e := a.Nlink, uint32(4); g != e {
+			t.Errorf("wrong link count: %d != %d", g, e)
+		}
+
+		root := filesys.dirNode(nil)
+		if err := root.Attr(ctx, &a); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := a.Size, uint64(1); g != e {
+			t.Errorf("wrong root size: %d != %d", g, e)
+		}
+		if g, e := a.Nlink, uint32(3); g != e {
+			t.Errorf("wrong root link count: %d != %d", g, e)
+		}
+
+		// cached until the TTL runs out
+		add := func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("bukkit")).Put([]byte("another"), []byte("x"))
+		}
+		if err := db.Update(add); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Attr(ctx, &a); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := a.Size, uint64(3); g != e {
+			t.Errorf("stats not cached: %d != %d", g, e)
+		}
+		filesys.statsTTL = 0
+		if err := d.Attr(ctx, &a); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := a.Size, uint64(4); g != e {
+			t.Errorf("wrong size without cache: %d != %d", g, e)
+		}
+	})
+}
+
+func TestStatfs(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("greeting"), []byte("hello"))
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		filesys := &FS{db: db}
+		resp := &fuse.StatfsResponse{}
+		if err := filesys.Statfs(context.Background(), &fuse.StatfsRequest{}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := resp.Bsize, uint32(db.Info().PageSize); g != e {
+			t.Errorf("wrong block size: %d != %d", g, e)
+		}
+		if resp.Blocks == 0 || resp.Bfree > resp.Blocks {
+			t.Errorf("bad block counts: %v", resp)
+		}
+		if g, e := resp.Files-resp.Ffree, uint64(2); g != e {
+			t.Errorf("wrong number of files in use: %d != %d", g, e)
+		}
+	})
+}
+
+func TestStatsOwnChanges(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			_, err = b.CreateBucket([]byte("sub"))
+			return err
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		filesys := &FS{db: db, statsTTL: time.Hour}
+		d := filesys.dirNode([][]byte{[]byte("bukkit")})
+		sub := filesys.dirNode([][]byte{[]byte("bukkit"), []byte("sub")})
+		check := func(what string, size uint64, nlink uint32, files uint64) {
+			var a fuse.Attr
+			if err := d.Attr(ctx, &a); err != nil {
+				t.Fatal(err)
+			}
+			if a.Size != size || a.Nlink != nlink {
+				t.Errorf("%s: wrong size and link count: %d %d != %d %d", what, a.Size, a.Nlink, size, nlink)
+			}
+			resp := &fuse.StatfsResponse{}
+			if err := filesys.Statfs(ctx, &fuse.StatfsRequest{}, resp); err != nil {
+				t.Fatal(err)
+			}
+			if g := resp.Files - resp.Ffree; g != files {
+				t.Errorf("%s: wrong number of files in use: %d != %d", what, g, files)
+			}
+		}
+		check("before", 1, 3, 2)
+
+		if _, err := sub.Mkdir(ctx, &fuse.MkdirRequest{Name: "deeper", Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+		check("after nested mkdir", 1, 3, 3)
+		if _, err := d.Mkdir(ctx, &fuse.MkdirRequest{Name: "other", Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+		check("after mkdir", 2, 4, 4)
+
+		_, h, err := d.Create(ctx, &fuse.CreateRequest{Name: "greeting", Mode: 0644}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.(*writeHandle).Flush(ctx, &fuse.FlushRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		check("after create", 3, 4, 5)
+
+		req := &fuse.RenameRequest{OldName: "other", NewName: "moved"}
+		if err := d.Rename(ctx, req, sub); err != nil {
+			t.Fatal(err)
+		}
+		check("after rename", 2, 3, 5)
+
+		if err := d.Remove(ctx, &fuse.RemoveRequest{Name: "greeting"}); err != nil {
+			t.Fatal(err)
+		}
+		check("after remove", 1, 3, 4)
+	})
+}
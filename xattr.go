@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+// Every key and bucket has read-only extended attributes under
+// boltXattrPrefix that show what the file name stands for in the
+// database:
+//
+//	user.bolt.key          the raw key or bucket name
+//	user.bolt.path         the raw names of the buckets from the root
+//	                       of the database, separated by NUL bytes
+//	user.bolt.stats        bucket statistics, as in .bolt/stats
+//	user.bolt.fillpercent  the fill percent Bolt splits pages at
+//
+// The last two are only on directories. Tools that copy all
+// attributes, like rsync -X or cp --preserve=xattr, also try to set
+// and remove these, so setting one to the value it already has, and
+// removing one, succeed without doing anything. Any other change
+// fails with EPERM.
+//
+// Directories can also have a key format hint, which selects how the
+// keys inside are shown, in the writable attribute keyFormatXattr.
+// Changing it takes effect for new lookups right away, but names the
+// kernel has cached stay valid until they time out.
+//
+// With metadata storage, any other attributes can be set, and are
+// kept in the metadata record of the node. They are thus moved along
+// on rename, and dropped on remove.
+const boltXattrPrefix = "user.bolt."
+
+const keyFormatXattr = boltXattrPrefix + "keyformat"
+
+// Flags of setxattr(2), which package syscall does not have. They
+// are the same on all platforms supported by the fuse package.
+const (
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// boltXattrNames returns the names of the read-only attributes of
+// the key, or bucket if dir is set, at path.
+func boltXattrNames(path [][]byte, dir bool) []string {
+	var names []string
+	if len(path) > 0 {
+		names = append(names, boltXattrPrefix+"key")
+	}
+	names = append(names, boltXattrPrefix+"path")
+	if dir {
+		names = append(names, boltXattrPrefix+"stats")
+		if len(path) > 0 {
+			names = append(names, boltXattrPrefix+"fillpercent")
+		}
+	}
+	return names
+}
+
+// boltXattr returns the value of the read-only attribute name of the
+// key, or bucket if dir is set, at path.
+func (f *FS) boltXattr(path [][]byte, dir bool, name string) ([]byte, error) {
+	found := false
+	for _, n := range boltXattrNames(path, dir) {
+		if n == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fuse.ErrNoXattr
+	}
+
+	switch name[len(boltXattrPrefix):] {
+	case "key":
+		return append([]byte(nil), path[len(path)-1]...), nil
+	case "path":
+		buckets := path
+		if !dir {
+			buckets = path[:len(path)-1]
+		}
+		return bytes.Join(buckets, []byte{0}), nil
+	case "stats":
+		s, err := f.bucketStats(path)
+		if err != nil {
+			return nil, err
+		}
+		return renderText(s), nil
+	case "fillpercent":
+		// not stored in the database; every transaction starts with
+		// the default
+		return []byte(strconv.FormatFloat(bolt.DefaultFillPercent, 'g', -1, 64)), nil
+	}
+	return nil, fuse.ErrNoXattr
+}
+
+// getXattr returns the value of the attribute name of the key, or
+// bucket if dir is set, at path.
+func (f *FS) getXattr(path [][]byte, dir bool, name string) ([]byte, error) {
+	if strings.HasPrefix(name, boltXattrPrefix) && name != keyFormatXattr {
+		return f.boltXattr(path, dir, name)
+	}
+	m, err := f.loadMeta(path)
+	if err != nil {
+		return nil, err
+	}
+	if name == keyFormatXattr {
+		if !dir || m.KeyFormat == "" {
+			return nil, fuse.ErrNoXattr
+		}
+		return []byte(m.KeyFormat), nil
+	}
+	v, ok := m.Xattrs[name]
+	if !ok {
+		return nil, fuse.ErrNoXattr
+	}
+	return v, nil
+}
+
+// listXattr returns the names of all attributes of the key, or
+// bucket if dir is set, at path.
+func (f *FS) listXattr(path [][]byte, dir bool) ([]string, error) {
+	m, err := f.loadMeta(path)
+	if err != nil {
+		return nil, err
+	}
+	user := make([]string, 0, len(m.Xattrs))
+	for name := range m.Xattrs {
+		user = append(user, name)
+	}
+	sort.Strings(user)
+	names := boltXattrNames(path, dir)
+	if dir && m.KeyFormat != "" {
+		names = append(names, keyFormatXattr)
+	}
+	return append(names, user...), nil
+}
+
+// checkSetXattr reports whether the attribute name of the key, or
+// bucket if dir is set, can be changed on this mount.
+func (f *FS) checkSetXattr(dir bool, name string) error {
+	if f.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	if strings.HasPrefix(name, boltXattrPrefix) && !(dir && name == keyFormatXattr) {
+		return fuse.EPERM
+	}
+	if !f.meta {
+		// nowhere to keep them
+		return fuse.ENOTSUP
+	}
+	return nil
+}
+
+// setXattr stores an attribute of the key, or bucket if dir is set,
+// at path.
+func (f *FS) setXattr(path [][]byte, dir bool, req *fuse.SetxattrRequest) error {
+	err := f.checkSetXattr(dir, req.Name)
+	if err == fuse.EPERM && req.Flags&xattrCreate == 0 {
+		// read-only, but setting it to what it is changes nothing
+		if v, gerr := f.boltXattr(path, dir, req.Name); gerr == nil && bytes.Equal(v, req.Xattr) {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if req.Name == keyFormatXattr {
+		if _, ok := keyFormats[string(req.Xattr)]; !ok {
+			// the errno cannot say which formats there are
+			log.Printf("unknown key format %q, want one of %s", req.Xattr, strings.Join(keyFormatNames(), ", "))
+			return fuse.Errno(syscall.EINVAL)
+		}
+	}
+	value := append([]byte(nil), req.Xattr...)
+	fn := func(tx *bolt.Tx) error {
+		m, err := getMeta(tx, path)
+		if err != nil {
+			return err
+		}
+		if req.Name == keyFormatXattr {
+			m.KeyFormat = string(value)
+			m.Ctime = time.Now()
+			return putMeta(tx, path, m)
+		}
+		_, exists := m.Xattrs[req.Name]
+		switch {
+		case req.Flags&xattrCreate != 0 && exists:
+			return fuse.EEXIST
+		case req.Flags&xattrReplace != 0 && !exists:
+			return fuse.ErrNoXattr
+		}
+		if m.Xattrs == nil {
+			m.Xattrs = make(map[string][]byte)
+		}
+		m.Xattrs[req.Name] = value
+		m.Ctime = time.Now()
+		return putMeta(tx, path, m)
+	}
+	return f.db.Update(fn)
+}
+
+// removeXattr deletes an attribute of the key, or bucket if dir is
+// set, at path.
+func (f *FS) removeXattr(path [][]byte, dir bool, name string) error {
+	err := f.checkSetXattr(dir, name)
+	if err == fuse.EPERM {
+		// read-only; it stays, see boltXattrPrefix
+		_, err = f.boltXattr(path, dir, name)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	fn := func(tx *bolt.Tx) error {
+		m, err := getMeta(tx, path)
+		if err != nil {
+			return err
+		}
+		if name == keyFormatXattr {
+			if m.KeyFormat == "" {
+				return fuse.ErrNoXattr
+			}
+			m.KeyFormat = ""
+		} else {
+			if _, ok := m.Xattrs[name]; !ok {
+				return fuse.ErrNoXattr
+			}
+			delete(m.Xattrs, name)
+		}
+		m.Ctime = time.Now()
+		return putMeta(tx, path, m)
+	}
+	return f.db.Update(fn)
+}
+
+var _ = fs.NodeGetxattrer(&Dir{})
+
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	v, err := d.fs.getXattr(d.path(), true, req.Name)
+	if err != nil {
+		return translateError(err)
+	}
+	resp.Xattr = v
+	return nil
+}
+
+var _ = fs.NodeListxattrer(&Dir{})
+
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	names, err := d.fs.listXattr(d.path(), true)
+	if err != nil {
+		return translateError(err)
+	}
+	resp.Append(names...)
+	return nil
+}
+
+var _ = fs.NodeSetxattrer(&Dir{})
+
+func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	return translateError(d.fs.setXattr(d.path(), true, req))
+}
+
+var _ = fs.NodeRemovexattrer(&Dir{})
+
+func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	return translateError(d.fs.removeXattr(d.path(), true, req.Name))
+}
+
+var _ = fs.NodeGetxattrer(&File{})
+
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v, err := f.dir.fs.getXattr(f.dir.childPath(f.name), false, req.Name)
+	if err != nil {
+		return translateError(err)
+	}
+	resp.Xattr = v
+	return nil
+}
+
+var _ = fs.NodeListxattrer(&File{})
+
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names, err := f.dir.fs.listXattr(f.dir.childPath(f.name), false)
+	if err != nil {
+		return translateError(err)
+	}
+	resp.Append(names...)
+	return nil
+}
+
+var _ = fs.NodeSetxattrer(&File{})
+
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return translateError(f.dir.fs.setXattr(f.dir.childPath(f.name), false, req))
+}
+
+var _ = fs.NodeRemovexattrer(&File{})
+
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return translateError(f.dir.fs.removeXattr(f.dir.childPath(f.name), false, req.Name))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"bazil.org/fuse"
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+func TestBoltXattrs(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("buk/kit"))
+			if err != nil {
+				return err
+			}
+			sub, err := b.CreateBucket([]byte{0x00, 0x2a})
+			if err != nil {
+				return err
+			}
+			return sub.Put([]byte("\x01key"), []byte("hello"))
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		filesys := &FS{db: db}
+		d := filesys.dirNode([][]byte{[]byte("buk/kit"), {0x00, 0x2a}})
+		f := filesys.fileNode(d, []byte("\x01key"))
+
+		get := func(n interface {
+			Getxattr(context.Context, *fuse.GetxattrRequest, *fuse.GetxattrResponse) error
+		}, name string) string {
+			resp := &fuse.GetxattrResponse{}
+			if err := n.Getxattr(ctx, &fuse.GetxattrRequest{Name: name}, resp); err != nil {
+				t.Fatalf("getxattr %s: %v", name, err)
+			}
+			return string(resp.Xattr)
+		}
+		if g, e := get(f, "user.bolt.key"), "\x01key"; g != e {
+			t.Errorf("wrong key: %q != %q", g, e)
+		}
+		if g, e := get(f, "user.bolt.path"), "buk/kit\x00\x00\x2a"; g != e {
+			t.Errorf("wrong file path: %q != %q", g, e)
+		}
+		if g, e := get(d, "user.bolt.key"), "\x00\x2a"; g != e {
+			t.Errorf("wrong bucket name: %q != %q", g, e)
+		}
+		if g, e := get(d, "user.bolt.fillpercent"), "0.5"; g != e {
+			t.Errorf("wrong fill percent: %q != %q", g, e)
+		}
+
+		resp := &fuse.GetxattrResponse{}
+		if err := f.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.bolt.stats"}, resp); err != fuse.ErrNoXattr {
+			t.Errorf("expected ErrNoXattr for file stats, got %v", err)
+		}
+
+		lresp := &fuse.ListxattrResponse{}
+		if err := d.Listxattr(ctx, &fuse.ListxattrRequest{}, lresp); err != nil {
+			t.Fatal(err)
+		}
+		want := &fuse.ListxattrResponse{}
+		want.Append("user.bolt.key", "user.bolt.path", "user.bolt.stats", "user.bolt.fillpercent")
+		if !reflect.DeepEqual(lresp.Xattr, want.Xattr) {
+			t.Errorf("wrong list: %q != %q", lresp.Xattr, want.Xattr)
+		}
+	})
+}
+
+func TestUserXattrs(t *testing.T) {
+	withDB(t, func(db *bolt.DB) {
+		prep := func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("bukkit"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("greeting"), []byte("hello"))
+		}
+		if err := db.Update(prep); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		filesys := &FS{db: db, meta: true}
+		d := filesys.dirNode([][]byte{[]byte("bukkit")})
+		f := filesys.fileNode(d, []byte("greeting"))
+
+		set := func(name, value string, flags uint32) error {
+			req := &fuse.SetxattrRequest{Name: name, Xattr: []byte(value), Flags: flags}
+			return f.Setxattr(ctx, req)
+		}
+		if err := set("user.tag", "red", 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := set("user.tag", "blue", xattrCreate); err != fuse.EEXIST {
+			t.Errorf("expected EEXIST, got %v", err)
+		}
+		if err := set("user.other", "x", xattrReplace); err != fuse.ErrNoXattr {
+			t.Errorf("expected ErrNoXattr, got %v", err)
+		}
+		if err := set("user.bolt.key", "x", 0); err != fuse.EPERM {
+			t.Errorf("expected EPERM, got %v", err)
+		}
+		// as when copying all attributes of the file
+		if err := set("user.bolt.key", "greeting", 0); err != nil {
+			t.Errorf("setting read-only attribute to its value: %v", err)
+		}
+		if err := f.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.bolt.key"}); err != nil {
+			t.Errorf("removing read-only attribute: %v", err)
+		}
+		if err := f.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.bolt.stats"}); err != fuse.ErrNoXattr {
+			t.Errorf("expected ErrNoXattr for file stats, got %v", err)
+		}
+
+		req := &fuse.RenameRequest{OldName: "greeting", NewName: "moved"}
+		if err := d.Rename(ctx, req, d); err != nil {
+			t.Fatal(err)
+		}
+		resp := &fuse.GetxattrResponse{}
+		if err := f.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.tag"}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if g, e := string(resp.Xattr), "red"; g != e {
+			t.Errorf("wrong value after rename: %q != %q", g, e)
+		}
+
+		lresp := &fuse.ListxattrResponse{}
+		if err := f.Listxattr(ctx, &fuse.ListxattrRequest{}, lresp); err != nil {
+			t.Fatal(err)
+		}
+		want := &fuse.ListxattrResponse{}
+		want.Append("user.bolt.key", "user.bolt.path", "user.tag")
+		if !reflect.DeepEqual(lresp.Xattr, want.Xattr) {
+			t.Errorf("wrong list: %q != %q", lresp.Xattr, want.Xattr)
+		}
+
+		if err := f.Removexattr(ctx, &fuse.RemovexattrRequest{Name: "user.tag"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Getxattr(ctx, &fuse.GetxattrRequest{Name: "user.tag"}, resp); err != fuse.ErrNoXattr {
+			t.Errorf("expected ErrNoXattr after remove, got %v", err)
+		}
+
+		filesys.meta = false
+		if err := set("user.tag", "red", 0); err != fuse.ENOTSUP {
+			t.Errorf("expected ENOTSUP without metadata, got %v", err)
+		}
+	})
+}